@@ -0,0 +1,37 @@
+package admin
+
+type config struct {
+	listen string
+	token  string
+	ctrl   IController
+}
+
+type Option func(c *config)
+
+// WithListen 管理接口的监听地址, 例如127.0.0.1:9901
+func WithListen(addr string) Option {
+	return func(c *config) {
+		c.listen = addr
+	}
+}
+
+// WithToken 请求需要携带Authorization: Bearer <token>
+func WithToken(token string) Option {
+	return func(c *config) {
+		c.token = token
+	}
+}
+
+func WithController(ctrl IController) Option {
+	return func(c *config) {
+		c.ctrl = ctrl
+	}
+}
+
+func applyOpts(opts ...Option) *config {
+	c := &config{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
@@ -0,0 +1,31 @@
+package admin
+
+type response struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type banRequest struct {
+	IP        string `json:"ip"`
+	Reason    string `json:"reason"`
+	Duration  uint64 `json:"duration"`  //封禁时长(秒), 为0时按封禁阶梯计算
+	Permanent bool   `json:"permanent"` //永久封禁, 优先于duration
+}
+
+type banResponse struct {
+	IsNew bool `json:"is_new"`
+}
+
+type unbanRequest struct {
+	IP string `json:"ip"`
+}
+
+type unbanResponse struct {
+	Exist bool `json:"exist"`
+}
+
+type whiteRequest struct {
+	IP       string `json:"ip"`
+	Duration uint64 `json:"duration"` //临时白名单时长(秒)
+}
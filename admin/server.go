@@ -0,0 +1,296 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ip-blackcage/model"
+	"ip-blackcage/utils"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultListLimit    = 100
+	defaultMaxListLimit = 1000
+	defaultMaxDuration  = 10 * 365 * 86400 //封禁/临时白名单时长的上限(秒), 更长的封禁使用permanent
+
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// IController 管理接口依赖的操作, 由IPBlackCage实现
+type IController interface {
+	ListBlackIP(ctx context.Context, ipPrefix string, offset, limit int64) ([]*model.BlackCageTab, error)
+	ManualBanIP(ctx context.Context, ip string, reason string, dur time.Duration) (bool, error)
+	ManualUnBanIP(ctx context.Context, ip string) (bool, error)
+	TempWhiteIP(ctx context.Context, ip string, dur time.Duration) error
+	ExplainIP(ctx context.Context, ip string) (*model.IPExplain, error)
+	ListEventHistory(ctx context.Context, ip string, offset, limit int64) ([]*model.EventHistoryTab, error)
+}
+
+type IServer interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+type defaultServer struct {
+	c   *config
+	svr *http.Server
+}
+
+func NewServer(opts ...Option) (IServer, error) {
+	c := applyOpts(opts...)
+	if len(c.listen) == 0 {
+		return nil, fmt.Errorf("no listen addr found")
+	}
+	if len(c.token) == 0 {
+		return nil, fmt.Errorf("no token found")
+	}
+	if c.ctrl == nil {
+		return nil, fmt.Errorf("no controller found")
+	}
+	s := &defaultServer{c: c}
+	s.svr = &http.Server{
+		Addr:              c.listen,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+		ReadTimeout:       defaultReadTimeout,
+		WriteTimeout:      defaultWriteTimeout,
+		IdleTimeout:       defaultIdleTimeout,
+	}
+	return s, nil
+}
+
+func (s *defaultServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/black_ips", s.handleListBlackIP)
+	mux.HandleFunc("POST /api/v1/ban", s.handleBan)
+	mux.HandleFunc("POST /api/v1/unban", s.handleUnban)
+	mux.HandleFunc("POST /api/v1/white", s.handleWhite)
+	mux.HandleFunc("GET /api/v1/explain", s.handleExplain)
+	mux.HandleFunc("GET /api/v1/history", s.handleListHistory)
+	return s.authMiddleware(mux)
+}
+
+func (s *defaultServer) authMiddleware(next http.Handler) http.Handler {
+	expect := []byte("Bearer " + s.c.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, expect) != 1 {
+			writeResponse(w, http.StatusUnauthorized, nil, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *defaultServer) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.c.listen)
+	if err != nil {
+		return fmt.Errorf("listen admin addr:%s failed, err:%w", s.c.listen, err)
+	}
+	go func() {
+		if err := s.svr.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logutil.GetLogger(ctx).Error("admin server exit", zap.Error(err))
+		}
+	}()
+	logutil.GetLogger(ctx).Info("admin server started", zap.String("listen", s.c.listen))
+	return nil
+}
+
+func (s *defaultServer) Stop(ctx context.Context) error {
+	return s.svr.Shutdown(ctx)
+}
+
+func writeResponse(w http.ResponseWriter, status int, data interface{}, err error) {
+	rsp := &response{Data: data}
+	if err != nil {
+		rsp.Code = status
+		rsp.Message = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(rsp)
+}
+
+// decodeRequest 解析请求体, 并将其中的ip转换为规范形式, 避免同一地址的不同写法产生多条记录
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}, ip *string) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("decode request failed, err:%w", err)
+	}
+	rs, err := utils.CanonicalIP(*ip)
+	if err != nil {
+		return err
+	}
+	*ip = rs
+	return nil
+}
+
+// statusOf 将控制器返回的错误映射为http状态码
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, model.ErrInvalidArgument):
+		return http.StatusBadRequest
+	case errors.Is(err, model.ErrConflict):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// toDuration 校验请求中的时长(秒), 避免过大的值在转换时溢出
+func toDuration(sec uint64) (time.Duration, error) {
+	if sec == 0 || sec > defaultMaxDuration {
+		return 0, fmt.Errorf("duration should be in range [1, %d], get:%d", defaultMaxDuration, sec)
+	}
+	return time.Duration(sec) * time.Second, nil
+}
+
+func parseInt64Query(r *http.Request, key string, def int64) (int64, error) {
+	v := strings.TrimSpace(r.URL.Query().Get(key))
+	if len(v) == 0 {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s:%s", key, v)
+	}
+	return n, nil
+}
+
+func parsePageQuery(r *http.Request) (int64, int64, error) {
+	offset, err := parseInt64Query(r, "offset", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	limit, err := parseInt64Query(r, "limit", defaultListLimit)
+	if err != nil {
+		return 0, 0, err
+	}
+	if limit == 0 || limit > defaultMaxListLimit {
+		limit = defaultMaxListLimit
+	}
+	return offset, limit, nil
+}
+
+func (s *defaultServer) handleListBlackIP(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := parsePageQuery(r)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	rs, err := s.c.ctrl.ListBlackIP(r.Context(), r.URL.Query().Get("ip"), offset, limit)
+	if err != nil {
+		writeResponse(w, statusOf(err), nil, err)
+		return
+	}
+	writeResponse(w, http.StatusOK, rs, nil)
+}
+
+func (s *defaultServer) handleListHistory(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := parsePageQuery(r)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	ip := strings.TrimSpace(r.URL.Query().Get("ip"))
+	if len(ip) > 0 {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			writeResponse(w, http.StatusBadRequest, nil, fmt.Errorf("invalid ip:%s", ip))
+			return
+		}
+		ip = parsed.String()
+	}
+	rs, err := s.c.ctrl.ListEventHistory(r.Context(), ip, offset, limit)
+	if err != nil {
+		writeResponse(w, statusOf(err), nil, err)
+		return
+	}
+	writeResponse(w, http.StatusOK, rs, nil)
+}
+
+func (s *defaultServer) handleBan(w http.ResponseWriter, r *http.Request) {
+	req := &banRequest{}
+	if err := decodeRequest(w, r, req, &req.IP); err != nil {
+		writeResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	dur := model.BanDurationAuto
+	if req.Permanent {
+		dur = 0
+	} else if req.Duration > 0 {
+		d, err := toDuration(req.Duration)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		dur = d
+	}
+	isNew, err := s.c.ctrl.ManualBanIP(r.Context(), req.IP, req.Reason, dur)
+	if err != nil {
+		writeResponse(w, statusOf(err), nil, err)
+		return
+	}
+	writeResponse(w, http.StatusOK, &banResponse{IsNew: isNew}, nil)
+}
+
+func (s *defaultServer) handleUnban(w http.ResponseWriter, r *http.Request) {
+	req := &unbanRequest{}
+	if err := decodeRequest(w, r, req, &req.IP); err != nil {
+		writeResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	exist, err := s.c.ctrl.ManualUnBanIP(r.Context(), req.IP)
+	if err != nil {
+		writeResponse(w, statusOf(err), nil, err)
+		return
+	}
+	writeResponse(w, http.StatusOK, &unbanResponse{Exist: exist}, nil)
+}
+
+func (s *defaultServer) handleWhite(w http.ResponseWriter, r *http.Request) {
+	req := &whiteRequest{}
+	if err := decodeRequest(w, r, req, &req.IP); err != nil {
+		writeResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	dur, err := toDuration(req.Duration)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	if err := s.c.ctrl.TempWhiteIP(r.Context(), req.IP, dur); err != nil {
+		writeResponse(w, statusOf(err), nil, err)
+		return
+	}
+	writeResponse(w, http.StatusOK, nil, nil)
+}
+
+func (s *defaultServer) handleExplain(w http.ResponseWriter, r *http.Request) {
+	ip := r.URL.Query().Get("ip")
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		writeResponse(w, http.StatusBadRequest, nil, fmt.Errorf("invalid ip:%s", ip))
+		return
+	}
+	ip = parsed.String()
+	rs, err := s.c.ctrl.ExplainIP(r.Context(), ip)
+	if err != nil {
+		writeResponse(w, statusOf(err), nil, err)
+		return
+	}
+	writeResponse(w, http.StatusOK, rs, nil)
+}
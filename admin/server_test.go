@@ -0,0 +1,109 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ip-blackcage/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeController struct {
+	banIP  string
+	banDur time.Duration
+	banErr error
+}
+
+func (f *fakeController) ListBlackIP(ctx context.Context, ipPrefix string, offset, limit int64) ([]*model.BlackCageTab, error) {
+	return []*model.BlackCageTab{{IP: ipPrefix + "1"}}, nil
+}
+
+func (f *fakeController) ManualBanIP(ctx context.Context, ip string, reason string, dur time.Duration) (bool, error) {
+	f.banIP = ip
+	f.banDur = dur
+	return f.banErr == nil, f.banErr
+}
+
+func (f *fakeController) ManualUnBanIP(ctx context.Context, ip string) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeController) TempWhiteIP(ctx context.Context, ip string, dur time.Duration) error {
+	return nil
+}
+
+func (f *fakeController) ExplainIP(ctx context.Context, ip string) (*model.IPExplain, error) {
+	return &model.IPExplain{IP: ip}, nil
+}
+
+func (f *fakeController) ListEventHistory(ctx context.Context, ip string, offset, limit int64) ([]*model.EventHistoryTab, error) {
+	return []*model.EventHistoryTab{{SrcIP: ip, Action: model.HistoryActionBan}}, nil
+}
+
+func TestServer(t *testing.T) {
+	ctrl := &fakeController{}
+	svr, err := NewServer(WithListen("127.0.0.1:0"), WithToken("abc"), WithController(ctrl))
+	assert.NoError(t, err)
+	h := svr.(*defaultServer).handler()
+	doRequest := func(method string, url string, body string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(t, http.StatusUnauthorized, doRequest(http.MethodGet, "/api/v1/black_ips", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(http.MethodGet, "/api/v1/black_ips", "", "bad").Code)
+
+	rec := doRequest(http.MethodGet, "/api/v1/black_ips?ip=1.2.3.", "", "abc")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "1.2.3.1")
+
+	rec = doRequest(http.MethodPost, "/api/v1/ban", `{"ip":"1.2.3.4","reason":"test"}`, "abc")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, model.BanDurationAuto, ctrl.banDur)
+	rec = doRequest(http.MethodPost, "/api/v1/ban", `{"ip":"1.2.3.4","permanent":true}`, "abc")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, time.Duration(0), ctrl.banDur)
+	rec = doRequest(http.MethodPost, "/api/v1/ban", `{"ip":"1.2.3.4","duration":60}`, "abc")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, time.Minute, ctrl.banDur)
+	assert.Equal(t, http.StatusBadRequest, doRequest(http.MethodPost, "/api/v1/ban", `{"ip":"1.2.3"}`, "abc").Code)
+	//过大的时长会在转换时溢出, 需要拒绝
+	assert.Equal(t, http.StatusBadRequest, doRequest(http.MethodPost, "/api/v1/ban", `{"ip":"1.2.3.4","duration":18446744073709551615}`, "abc").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(http.MethodPost, "/api/v1/white", `{"ip":"1.2.3.4","duration":9223372037}`, "abc").Code)
+	ctrl.banErr = fmt.Errorf("ip is whitelisted, err:%w", model.ErrConflict)
+	assert.Equal(t, http.StatusConflict, doRequest(http.MethodPost, "/api/v1/ban", `{"ip":"1.2.3.4"}`, "abc").Code)
+	ctrl.banErr = fmt.Errorf("%w, bad ip", model.ErrInvalidArgument)
+	assert.Equal(t, http.StatusBadRequest, doRequest(http.MethodPost, "/api/v1/ban", `{"ip":"1.2.3.4"}`, "abc").Code)
+	ctrl.banErr = errors.New("db error")
+	assert.Equal(t, http.StatusInternalServerError, doRequest(http.MethodPost, "/api/v1/ban", `{"ip":"1.2.3.4"}`, "abc").Code)
+	ctrl.banErr = nil
+	//ip在传给控制器前转换为规范形式
+	assert.Equal(t, http.StatusOK, doRequest(http.MethodPost, "/api/v1/ban", `{"ip":"::ffff:1.2.3.4"}`, "abc").Code)
+	assert.Equal(t, "1.2.3.4", ctrl.banIP)
+	assert.Equal(t, http.StatusOK, doRequest(http.MethodPost, "/api/v1/ban", `{"ip":"2001:DB8::1"}`, "abc").Code)
+	assert.Equal(t, "2001:db8::1", ctrl.banIP)
+	assert.Equal(t, http.StatusOK, doRequest(http.MethodPost, "/api/v1/ban", `{"ip":"1.2.3.4/24"}`, "abc").Code)
+	assert.Equal(t, "1.2.3.0/24", ctrl.banIP)
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(http.MethodPost, "/api/v1/white", `{"ip":"1.2.3.4"}`, "abc").Code)
+	assert.Equal(t, http.StatusOK, doRequest(http.MethodPost, "/api/v1/white", `{"ip":"1.2.3.4","duration":60}`, "abc").Code)
+	assert.Equal(t, http.StatusOK, doRequest(http.MethodPost, "/api/v1/unban", `{"ip":"1.2.3.4"}`, "abc").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(http.MethodGet, "/api/v1/explain?ip=x", "", "abc").Code)
+	rec = doRequest(http.MethodGet, "/api/v1/explain?ip=1.2.3.4", "", "abc")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"ip":"1.2.3.4"`)
+	assert.Equal(t, http.StatusBadRequest, doRequest(http.MethodGet, "/api/v1/history?ip=x", "", "abc").Code)
+	rec = doRequest(http.MethodGet, "/api/v1/history?ip=1.2.3.4&limit=10", "", "abc")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"src_ip":"1.2.3.4"`)
+}
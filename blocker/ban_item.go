@@ -0,0 +1,62 @@
+package blocker
+
+import (
+	"ip-blackcage/ipset"
+	"ip-blackcage/utils"
+	"time"
+)
+
+// MaxTimeout 内核集合支持的最大超时, 更长的封禁按该值写入, 由调用方在条目超时前重新写入续期
+const MaxTimeout = time.Duration(ipset.MaxTimeout) * time.Second
+
+// BanItem 黑名单条目, Timeout为0时表示永久拦截, Scope为nil时拦截全部流量
+type BanItem struct {
+	IP      string
+	Timeout time.Duration
+	Scope   *BanScope
+}
+
+func toBanItems(ips []string) []*BanItem {
+	rs := make([]*BanItem, 0, len(ips))
+	for _, ip := range ips {
+		rs = append(rs, &BanItem{IP: ip})
+	}
+	return rs
+}
+
+func splitBanItemsByFamily(items []*BanItem) ([]*BanItem, []*BanItem, error) {
+	v4 := make([]*BanItem, 0, len(items))
+	v6 := make([]*BanItem, 0, 16)
+	for _, item := range items {
+		ok, err := utils.IsIPv4(item.IP)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			v4 = append(v4, item)
+			continue
+		}
+		v6 = append(v6, item)
+	}
+	return v4, v6, nil
+}
+
+// clampTimeout 超出内核上限的时长按上限写入, 0表示永久
+func clampTimeout(d time.Duration) time.Duration {
+	if d > MaxTimeout {
+		return MaxTimeout
+	}
+	return d
+}
+
+// toSetTimeout 将拦截时长转换为ipset的超时秒数, 超出内核上限的条目按上限写入
+func toSetTimeout(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	sec := uint64((d + time.Second - 1) / time.Second)
+	if sec > ipset.MaxTimeout {
+		return ipset.MaxTimeout
+	}
+	return sec
+}
@@ -0,0 +1,20 @@
+package blocker
+
+import (
+	"ip-blackcage/ipset"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToSetTimeout(t *testing.T) {
+	assert.Equal(t, uint64(0), toSetTimeout(0))
+	assert.Equal(t, uint64(0), toSetTimeout(-1*time.Second))
+	assert.Equal(t, uint64(1), toSetTimeout(10*time.Millisecond))
+	assert.Equal(t, uint64(3600), toSetTimeout(time.Hour))
+	assert.Equal(t, ipset.MaxTimeout, toSetTimeout(90*24*time.Hour))
+	assert.Equal(t, ipset.MaxTimeout, toSetTimeout(MaxTimeout+time.Millisecond))
+	assert.Equal(t, MaxTimeout, clampTimeout(90*24*time.Hour))
+	assert.Equal(t, time.Hour, clampTimeout(time.Hour))
+}
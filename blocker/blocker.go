@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"ip-blackcage/ipset"
+	"ip-blackcage/utils"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/xxxsen/common/logutil"
@@ -14,69 +17,185 @@ import (
 const (
 	defaultBlackSet        = "ip-blackcage-blacklist-set"
 	defaultWhiteSet        = "ip-blackcage-whitelist-set"
+	defaultBlackSet6       = "ip-blackcage-blacklist6-set"
+	defaultWhiteSet6       = "ip-blackcage-whitelist6-set"
+	defaultTCPSet          = "ip-blackcage-tcp-set"
+	defaultTCPSet6         = "ip-blackcage-tcp6-set"
+	defaultUDPSet          = "ip-blackcage-udp-set"
+	defaultUDPSet6         = "ip-blackcage-udp6-set"
+	defaultPortSet         = "ip-blackcage-port-set"
+	defaultPortSet6        = "ip-blackcage-port6-set"
 	defaultFilterTable     = "filter"
 	defaultCageChain       = "ip-blackcage-chain"
 	defaultDockerUserChain = "DOCKER-USER"
 	defaultInputChain      = "INPUT"
 	defaultForwardChain    = "FORWARD"
+	defaultTarpitLimit     = "bc-tarpit"
+	defaultTarpitLimit6    = "bc-tarpit6"
+)
+
+const (
+	BackendIPTables = "iptables"
+	BackendNFTables = "nftables"
 )
 
 type IBlocker interface {
-	Init(ctx context.Context, blackips []string, whiteips []string) error
+	Init(ctx context.Context, blackips []*BanItem, whiteips []string) error
 	Destroy(ctx context.Context) error
-	BanIP(ctx context.Context, ip string) error
-	UnBanIP(ctx context.Context, ip string) error
+	// BanIP 按封禁范围拦截ip, scope为nil时拦截全部流量, timeout超过MaxTimeout时按MaxTimeout写入
+	BanIP(ctx context.Context, ip string, scope *BanScope, timeout time.Duration) error
+	// UnBanIP 解除封禁, scope需要与封禁时一致
+	UnBanIP(ctx context.Context, ip string, scope *BanScope) error
 	WhiteIP(ctx context.Context, ip string) error
 	UnWhiteIP(ctx context.Context, ip string) error
+	// Stats 读取内核中各集合当前的元素数及容量
+	Stats(ctx context.Context) ([]*SetStat, error)
+	// EntriesOf 返回按封禁范围封禁ip时各集合中需要占用的元素数, 用于封禁前检查集合容量
+	EntriesOf(ip string, scope *BanScope) (map[string]int, error)
+	// Repair 检查链/规则/集合是否被外部修改, 并修复可以原地修复的部分
+	Repair(ctx context.Context) (*Drift, error)
+}
+
+type SetStat struct {
+	Name       string
+	Entries    int
+	MaxEntries int //集合容量, 0表示不限制
+}
+
+// familyTable 单个协议族(ipv4/ipv6)对应的iptables实例及ipset集合
+type familyTable struct {
+	family   ipset.Family
+	ipt      *iptables.IPTables
+	blackSet string
+	whiteSet string
+	tcpSet   string //按协议封禁
+	udpSet   string
+	portSet  string //按端口封禁, 类型为hash:net,port
+}
+
+func (ft *familyTable) sets() []string {
+	return []string{ft.blackSet, ft.whiteSet, ft.tcpSet, ft.udpSet, ft.portSet}
+}
+
+// banEntries 按封禁范围返回各集合中需要写入的元素
+func (ft *familyTable) banEntries(ip string, scope *BanScope) map[string][]string {
+	if scope == nil {
+		return map[string][]string{ft.blackSet: {ip}}
+	}
+	if len(scope.Ports) > 0 {
+		return map[string][]string{ft.portSet: scope.portEntries(ip)}
+	}
+	rs := make(map[string][]string, 2)
+	for _, proto := range scope.Protocols() {
+		set := ft.tcpSet
+		if proto == ProtocolUDP {
+			set = ft.udpSet
+		}
+		rs[set] = []string{ip}
+	}
+	return rs
 }
 
 type defaultBlocker struct {
-	ipt *iptables.IPTables
-	set *ipset.IPSet
+	set ipset.IIPSet
 	c   *config
+	v4  *familyTable
+	v6  *familyTable
 }
 
 func NewBlocker(opts ...Option) (IBlocker, error) {
 	c := applyOpts(opts...)
-	set, err := ipset.New()
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	set, err := ipset.NewClient(context.Background(), c.ipsetDriver)
+	if err != nil {
+		return nil, err
+	}
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	if err != nil {
 		return nil, err
 	}
-	ipt, err := iptables.New()
+	ipt6, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
 	if err != nil {
 		return nil, err
 	}
 	return &defaultBlocker{
-		ipt: ipt,
 		set: set,
 		c:   c,
+		v4: &familyTable{
+			family:   ipset.FamilyInet,
+			ipt:      ipt,
+			blackSet: defaultBlackSet,
+			whiteSet: defaultWhiteSet,
+			tcpSet:   defaultTCPSet,
+			udpSet:   defaultUDPSet,
+			portSet:  defaultPortSet,
+		},
+		v6: &familyTable{
+			family:   ipset.FamilyInet6,
+			ipt:      ipt6,
+			blackSet: defaultBlackSet6,
+			whiteSet: defaultWhiteSet6,
+			tcpSet:   defaultTCPSet6,
+			udpSet:   defaultUDPSet6,
+			portSet:  defaultPortSet6,
+		},
 	}, nil
 }
 
-func (f *defaultBlocker) getBlackSet() string {
-	return defaultBlackSet
+func (f *defaultBlocker) families() []*familyTable {
+	return []*familyTable{f.v4, f.v6}
 }
 
-func (f *defaultBlocker) getWhiteSet() string {
-	return defaultWhiteSet
+func (f *defaultBlocker) familyOf(ip string) (*familyTable, error) {
+	ok, err := utils.IsIPv4(ip)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return f.v4, nil
+	}
+	return f.v6, nil
 }
 
 func (f *defaultBlocker) getTmpSet(n string) string {
 	return n + "-tmp"
 }
 
-func (f *defaultBlocker) ensureIPSet(ctx context.Context, setname string, ips []string) error {
+// headerMatches 判断已存在集合的参数(协议族, 容量, 是否支持超时)是否与期望一致, maxelem为0时使用内核默认值, 不做比较
+func headerMatches(h *ipset.Header, family ipset.Family, maxelem uint64, withTimeout bool) bool {
+	if h.Family != string(family) || (h.Timeout != nil) != withTimeout {
+		return false
+	}
+	return maxelem == 0 || uint64(h.Maxelem) == maxelem
+}
+
+// ensureIPSet 通过临时集合+swap+destroy的方式重建集合, 已存在的集合可能被iptables规则引用而无法直接销毁
+// swap会连同集合参数一起替换, 持久模式下沿用的集合在参数变化(如cage_size调整)后同样会按当前配置重建
+func (f *defaultBlocker) ensureIPSet(ctx context.Context, ft *familyTable, setname string, typ ipset.SetType, entries []ipset.Entry, withTimeout bool) error {
 	tmpset := f.getTmpSet(setname)
-	if err := f.set.Create(ctx, setname, ipset.SetTypeHashNet, ipset.WithMaxElement(f.c.cageSize), ipset.WithExist()); err != nil {
-		return fmt.Errorf("create ip set failed, err:%w", err)
+	createOpts := []ipset.CmdOption{ipset.WithFamily(ft.family), ipset.WithMaxElement(f.c.cageSize), ipset.WithExist()}
+	if withTimeout { //默认超时为0, 即未指定超时的元素永久有效
+		createOpts = append(createOpts, ipset.WithTimeout(0))
+	}
+	header, _, err := f.set.List(ctx, setname, ipset.WithTerse())
+	if err != nil {
+		if err := f.set.Create(ctx, setname, typ, createOpts...); err != nil {
+			return fmt.Errorf("create ip set failed, err:%w", err)
+		}
+	} else if !headerMatches(header, ft.family, f.c.cageSize, withTimeout) {
+		logutil.GetLogger(ctx).Info("ip set header changed, rebuild it", zap.String("set", setname),
+			zap.Int("old_maxelem", header.Maxelem), zap.Uint64("new_maxelem", f.c.cageSize),
+			zap.Bool("old_timeout", header.Timeout != nil), zap.Bool("new_timeout", withTimeout))
 	}
 	if err := f.set.Destroy(ctx, tmpset, ipset.WithExist()); err != nil {
 		return fmt.Errorf("destroy ip tmp set failed, err:%w", err)
 	}
-	if err := f.set.Create(ctx, tmpset, ipset.SetTypeHashNet, ipset.WithMaxElement(f.c.cageSize), ipset.WithExist()); err != nil {
+	if err := f.set.Create(ctx, tmpset, typ, createOpts...); err != nil {
 		return fmt.Errorf("create ip tmp set failed, err:%w", err)
 	}
-	if err := f.set.Restore(ctx, tmpset, ips); err != nil {
+	if err := f.set.RestoreEntries(ctx, tmpset, entries); err != nil {
 		return fmt.Errorf("restore ipset failed, err:%w", err)
 	}
 	if err := f.set.Swap(ctx, tmpset, setname); err != nil {
@@ -85,77 +204,147 @@ func (f *defaultBlocker) ensureIPSet(ctx context.Context, setname string, ips []
 	if err := f.set.Destroy(ctx, tmpset, ipset.WithExist()); err != nil {
 		return fmt.Errorf("destroy tmp set failed, err:%w", err)
 	}
-	return nil
-}
-
-func (f *defaultBlocker) ensureBaseChain(_ context.Context) error {
-	table := defaultFilterTable
-	chain := defaultCageChain
-	blackset := f.getBlackSet()
-	whiteset := f.getWhiteSet()
-	ok, err := f.ipt.ChainExists(table, chain)
+	//容量检查依赖内核中的maxelem, 重建后校验参数确实已生效
+	header, _, err = f.set.List(ctx, setname, ipset.WithTerse())
 	if err != nil {
-		return err
+		return fmt.Errorf("list ip set after rebuild failed, err:%w", err)
 	}
-	if !ok {
-		if err := f.ipt.NewChain(table, chain); err != nil {
-			return err
-		}
+	if !headerMatches(header, ft.family, f.c.cageSize, withTimeout) {
+		return fmt.Errorf("ip set:%s header mismatch after rebuild, maxelem:%d, timeout:%t", setname, header.Maxelem, header.Timeout != nil)
 	}
+	return nil
+}
+
+type ruleSpec struct {
+	name string
+	args []string
+}
 
-	rules := []struct {
-		name string
-		args []string
-	}{
+func (f *defaultBlocker) baseRules(ft *familyTable) []ruleSpec {
+	rules := []ruleSpec{
 		{
 			name: "skip whitelist",
-			args: []string{"-m", "set", "--match-set", whiteset, "src", "-j", "RETURN"},
+			args: []string{"-m", "set", "--match-set", ft.whiteSet, "src", "-j", "RETURN"},
 		},
 		{
 			name: "allow established",
 			args: []string{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
 		},
-		{
-			name: "drop traffic",
-			args: []string{"-m", "set", "--match-set", blackset, "src", "-j", "DROP"},
-		},
-		{
-			name: "return origin",
-			args: []string{"-j", "RETURN"},
-		},
 	}
-	for _, rule := range rules {
-		if err := f.ipt.AppendUnique(table, chain, rule.args...); err != nil {
+	rules = append(rules, f.banRules(ft)...)
+	return append(rules, ruleSpec{
+		name: "return origin",
+		args: []string{"-j", "RETURN"},
+	})
+}
+
+type banMatch struct {
+	proto string //匹配条件中已限定的协议
+	args  []string
+}
+
+// banMatches 全局黑名单及各封禁范围集合的匹配条件
+func (ft *familyTable) banMatches() []banMatch {
+	return []banMatch{
+		{args: []string{"-m", "set", "--match-set", ft.blackSet, "src"}},
+		{proto: ProtocolTCP, args: []string{"-p", "tcp", "-m", "set", "--match-set", ft.tcpSet, "src"}},
+		{proto: ProtocolUDP, args: []string{"-p", "udp", "-m", "set", "--match-set", ft.udpSet, "src"}},
+		{args: []string{"-m", "set", "--match-set", ft.portSet, "src,dst"}},
+	}
+}
+
+// banRules 命中黑名单后的处理规则, 与配置的处理方式对应
+func (f *defaultBlocker) banRules(ft *familyTable) []ruleSpec {
+	rs := make([]ruleSpec, 0, 8)
+	for _, m := range ft.banMatches() {
+		rs = append(rs, f.banRulesOf(ft, m)...)
+	}
+	return rs
+}
+
+func (f *defaultBlocker) banRulesOf(ft *familyTable, m banMatch) []ruleSpec {
+	withMatch := func(prefix []string, suffix ...string) []string {
+		args := append([]string{}, prefix...)
+		args = append(args, m.args...)
+		return append(args, suffix...)
+	}
+	drop := ruleSpec{name: "drop traffic", args: withMatch(nil, "-j", "DROP")}
+	switch f.c.banAction {
+	case ActionReject:
+		unreach := "icmp-port-unreachable"
+		if ft.family == ipset.FamilyInet6 {
+			unreach = "icmp6-port-unreachable"
+		}
+		rs := make([]ruleSpec, 0, 2)
+		switch m.proto {
+		case "":
+			rs = append(rs, ruleSpec{name: "reject tcp", args: withMatch([]string{"-p", "tcp"}, "-j", "REJECT", "--reject-with", "tcp-reset")})
+		case ProtocolTCP:
+			return append(rs, ruleSpec{name: "reject tcp", args: withMatch(nil, "-j", "REJECT", "--reject-with", "tcp-reset")})
+		}
+		return append(rs, ruleSpec{name: "reject traffic", args: withMatch(nil, "-j", "REJECT", "--reject-with", unreach)})
+	case ActionTarpit:
+		name := defaultTarpitLimit
+		if ft.family == ipset.FamilyInet6 {
+			name = defaultTarpitLimit6
+		}
+		rate := fmt.Sprintf("%d/minute", f.c.tarpitRate)
+		return []ruleSpec{
+			{name: "tarpit trickle", args: withMatch(nil,
+				"-m", "hashlimit", "--hashlimit-upto", rate, "--hashlimit-burst", strconv.Itoa(int(f.c.tarpitRate)),
+				"--hashlimit-mode", "srcip", "--hashlimit-name", name, "-j", "RETURN")},
+			drop,
+		}
+	default:
+		return []ruleSpec{drop}
+	}
+}
+
+func (f *defaultBlocker) ensureBaseChain(_ context.Context, ft *familyTable) error {
+	table := defaultFilterTable
+	chain := defaultCageChain
+	ok, err := ft.ipt.ChainExists(table, chain)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := ft.ipt.NewChain(table, chain); err != nil {
+			return err
+		}
+	}
+	for _, rule := range f.baseRules(ft) {
+		if err := ft.ipt.AppendUnique(table, chain, rule.args...); err != nil {
 			return fmt.Errorf("create rule:%s failed, err:%w", rule.name, err)
 		}
 	}
 	return nil
 }
 
-func (f *defaultBlocker) ensureJumpChain(_ context.Context, srcChain string) error {
+func (f *defaultBlocker) ensureJumpChain(_ context.Context, ft *familyTable, srcChain string) error {
 	table := defaultFilterTable
 	chain := defaultCageChain
-	if err := f.ipt.InsertUnique(table, srcChain, 1, "-j", chain); err != nil {
+	if err := ft.ipt.InsertUnique(table, srcChain, 1, "-j", chain); err != nil {
 		return fmt.Errorf("insert chain jump failed, src_chain:%s, err:%w", srcChain, err)
 	}
 	return nil
 }
 
-func (f *defaultBlocker) ensureInputChain(ctx context.Context) error {
-	return f.ensureJumpChain(ctx, defaultInputChain)
+func (f *defaultBlocker) ensureInputChain(ctx context.Context, ft *familyTable) error {
+	return f.ensureJumpChain(ctx, ft, defaultInputChain)
 }
 
-func (f *defaultBlocker) ensureForwardChain(ctx context.Context) error {
-	return f.ensureJumpChain(ctx, defaultForwardChain)
+func (f *defaultBlocker) ensureForwardChain(ctx context.Context, ft *familyTable) error {
+	return f.ensureJumpChain(ctx, ft, defaultForwardChain)
 }
 
-func (f *defaultBlocker) deleteJumpChain(ctx context.Context, srcChain string) error {
+func (f *defaultBlocker) deleteJumpChain(ctx context.Context, ft *familyTable, srcChain string) error {
 	table := defaultFilterTable
 	chain := defaultCageChain
-	if err := f.ipt.DeleteIfExists(table, srcChain, "-j", chain); err != nil {
+	if err := ft.ipt.DeleteIfExists(table, srcChain, "-j", chain); err != nil {
 		if !strings.Contains(err.Error(), "does not exist") {
 			logutil.GetLogger(ctx).Error("delete chain jump rule failed",
 				zap.String("src_chain", srcChain),
+				zap.String("family", string(ft.family)),
 				zap.Error(err))
 			return err
 		}
@@ -163,95 +352,317 @@ func (f *defaultBlocker) deleteJumpChain(ctx context.Context, srcChain string) e
 	return nil
 }
 
-func (f *defaultBlocker) ensureDockerChain(_ context.Context) error {
+func (f *defaultBlocker) ensureDockerChain(_ context.Context, ft *familyTable) error {
 	table := defaultFilterTable
 	chain := defaultCageChain
 	dockerchain := defaultDockerUserChain
-	ok, err := f.ipt.ChainExists(table, dockerchain)
+	ok, err := ft.ipt.ChainExists(table, dockerchain)
 	if err != nil {
 		return err
 	}
 	if !ok {
-		if err := f.ipt.NewChain(table, dockerchain); err != nil {
+		if err := ft.ipt.NewChain(table, dockerchain); err != nil {
 			return err
 		}
 	}
-	if err = f.ipt.InsertUnique(table, dockerchain, 1, "-j", chain); err != nil {
+	if err = ft.ipt.InsertUnique(table, dockerchain, 1, "-j", chain); err != nil {
 		return fmt.Errorf("append docker chain failed, err:%w", err)
 	}
 	return nil
 }
 
-func (f *defaultBlocker) ensureIPTable(ctx context.Context) error {
-	if err := f.ensureBaseChain(ctx); err != nil {
-		return fmt.Errorf("ensure base chain failed, err:%w", err)
+func (f *defaultBlocker) ensureIPTable(ctx context.Context, ft *familyTable) error {
+	if err := f.ensureBaseChain(ctx, ft); err != nil {
+		return fmt.Errorf("ensure base chain failed, family:%s, err:%w", ft.family, err)
 	}
-	if err := f.ensureInputChain(ctx); err != nil {
-		return fmt.Errorf("ensure input chain failed, err:%w", err)
+	if err := f.ensureInputChain(ctx, ft); err != nil {
+		return fmt.Errorf("ensure input chain failed, family:%s, err:%w", ft.family, err)
 	}
-	if err := f.ensureForwardChain(ctx); err != nil {
-		return fmt.Errorf("ensure forward chain failed, err:%w", err)
+	if err := f.ensureForwardChain(ctx, ft); err != nil {
+		return fmt.Errorf("ensure forward chain failed, family:%s, err:%w", ft.family, err)
 	}
-	if err := f.ensureDockerChain(ctx); err != nil {
-		return fmt.Errorf("ensure docker chain failed, err:%w", err)
+	if err := f.ensureDockerChain(ctx, ft); err != nil {
+		return fmt.Errorf("ensure docker chain failed, family:%s, err:%w", ft.family, err)
 	}
 	return nil
 }
 
-func (f *defaultBlocker) Destroy(ctx context.Context) error {
+func (f *defaultBlocker) destroyFamily(ctx context.Context, ft *familyTable) error {
 	table := defaultFilterTable
 	chain := defaultCageChain
-	blackset := f.getBlackSet()
-	whiteset := f.getWhiteSet()
 	//移除docker-user链上的处理流程
-	if err := f.ipt.DeleteIfExists(table, defaultDockerUserChain, "-j", chain); err != nil {
+	if err := ft.ipt.DeleteIfExists(table, defaultDockerUserChain, "-j", chain); err != nil {
 		if !strings.Contains(err.Error(), "does not exist") {
-			logutil.GetLogger(ctx).Error("delete docker-user chain jump rule failed", zap.Error(err))
+			logutil.GetLogger(ctx).Error("delete docker-user chain jump rule failed", zap.String("family", string(ft.family)), zap.Error(err))
 			return err
 		}
 	}
-	if err := f.deleteJumpChain(ctx, defaultInputChain); err != nil {
+	if err := f.deleteJumpChain(ctx, ft, defaultInputChain); err != nil {
 		return err
 	}
-	if err := f.deleteJumpChain(ctx, defaultForwardChain); err != nil {
+	if err := f.deleteJumpChain(ctx, ft, defaultForwardChain); err != nil {
 		return err
 	}
-	if err := f.ipt.ClearAndDeleteChain(table, chain); err != nil {
-		return fmt.Errorf("clean and delete chain failed, err:%w", err)
+	if err := ft.ipt.ClearAndDeleteChain(table, chain); err != nil {
+		return fmt.Errorf("clean and delete chain failed, family:%s, err:%w", ft.family, err)
+	}
+	for _, set := range ft.sets() {
+		_ = f.set.Destroy(ctx, set, ipset.WithExist())
 	}
-	_ = f.set.Destroy(ctx, blackset, ipset.WithExist())
-	_ = f.set.Destroy(ctx, whiteset, ipset.WithExist())
 	return nil
 }
 
-func (f *defaultBlocker) Init(ctx context.Context, blackIps []string, whiteIps []string) error {
-	if err := f.Destroy(ctx); err != nil { //先进行预处理
-		return fmt.Errorf("destroy before init failed, err:%w", err)
+func (f *defaultBlocker) Destroy(ctx context.Context) error {
+	for _, ft := range f.families() {
+		if err := f.destroyFamily(ctx, ft); err != nil {
+			return err
+		}
 	}
-	if err := f.ensureIPSet(ctx, f.getWhiteSet(), whiteIps); err != nil {
-		return fmt.Errorf("ensure white ip set failed, err:%w", err)
+	return nil
+}
+
+func (f *defaultBlocker) initFamily(ctx context.Context, ft *familyTable, blackIps []*BanItem, whiteIps []*BanItem) error {
+	whiteEntries := make([]ipset.Entry, 0, len(whiteIps))
+	for _, item := range whiteIps {
+		whiteEntries = append(whiteEntries, ipset.Entry{Data: item.IP})
 	}
-	if err := f.ensureIPSet(ctx, f.getBlackSet(), blackIps); err != nil {
-		return fmt.Errorf("ensure black ip set failed, err:%w", err)
+	if err := f.ensureIPSet(ctx, ft, ft.whiteSet, ipset.SetTypeHashNet, whiteEntries, false); err != nil {
+		return fmt.Errorf("ensure white ip set failed, family:%s, err:%w", ft.family, err)
 	}
-	if err := f.ensureIPTable(ctx); err != nil {
+	blackEntries := make(map[string][]ipset.Entry, 4)
+	for _, item := range blackIps {
+		for set, datas := range ft.banEntries(item.IP, item.Scope) {
+			for _, data := range datas {
+				blackEntries[set] = append(blackEntries[set], ipset.Entry{Data: data, Timeout: toSetTimeout(item.Timeout)})
+			}
+		}
+	}
+	for _, set := range []string{ft.blackSet, ft.tcpSet, ft.udpSet, ft.portSet} {
+		typ := ipset.SetTypeHashNet
+		if set == ft.portSet {
+			typ = ipset.SetTypeHashNetPort
+		}
+		if err := f.ensureIPSet(ctx, ft, set, typ, blackEntries[set], true); err != nil {
+			return fmt.Errorf("ensure black ip set:%s failed, family:%s, err:%w", set, ft.family, err)
+		}
+	}
+	if err := f.ensureIPTable(ctx, ft); err != nil {
 		return err
 	}
+	if !f.c.persistent {
+		return nil
+	}
+	//沿用已有规则时, 规则的顺序/跳转位置可能已经被修改, 原地校正
+	drift := &Drift{}
+	if err := f.repairBaseChain(ctx, ft, drift); err != nil {
+		return fmt.Errorf("repair base chain failed, family:%s, err:%w", ft.family, err)
+	}
+	for _, src := range []string{defaultInputChain, defaultForwardChain, defaultDockerUserChain} {
+		if err := f.repairJump(ctx, ft, src, drift); err != nil {
+			return fmt.Errorf("repair jump failed, family:%s, src_chain:%s, err:%w", ft.family, src, err)
+		}
+	}
 	return nil
 }
 
-func (f *defaultBlocker) BanIP(ctx context.Context, ip string) error {
-	return f.set.Add(ctx, f.getBlackSet(), ip, ipset.WithExist())
+func (f *defaultBlocker) Init(ctx context.Context, blackIps []*BanItem, whiteIps []string) error {
+	if !f.c.persistent {
+		if err := f.Destroy(ctx); err != nil { //先进行预处理
+			return fmt.Errorf("destroy before init failed, err:%w", err)
+		}
+	}
+	blackIps4, blackIps6, err := splitBanItemsByFamily(blackIps)
+	if err != nil {
+		return fmt.Errorf("split black ips failed, err:%w", err)
+	}
+	whiteIps4, whiteIps6, err := splitBanItemsByFamily(toBanItems(whiteIps))
+	if err != nil {
+		return fmt.Errorf("split white ips failed, err:%w", err)
+	}
+	if err := f.initFamily(ctx, f.v4, blackIps4, whiteIps4); err != nil {
+		return err
+	}
+	if err := f.initFamily(ctx, f.v6, blackIps6, whiteIps6); err != nil {
+		return err
+	}
+	return nil
 }
 
-func (f *defaultBlocker) UnBanIP(ctx context.Context, ip string) error {
-	return f.set.Del(ctx, f.getBlackSet(), ip, ipset.WithExist())
+func (f *defaultBlocker) BanIP(ctx context.Context, ip string, scope *BanScope, timeout time.Duration) error {
+	ft, err := f.familyOf(ip)
+	if err != nil {
+		return err
+	}
+	opts := []ipset.CmdOption{ipset.WithExist()}
+	if sec := toSetTimeout(timeout); sec > 0 {
+		opts = append(opts, ipset.WithTimeout(sec))
+	}
+	for set, datas := range ft.banEntries(ip, scope) {
+		for _, data := range datas {
+			if err := f.set.Add(ctx, set, data, opts...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *defaultBlocker) UnBanIP(ctx context.Context, ip string, scope *BanScope) error {
+	ft, err := f.familyOf(ip)
+	if err != nil {
+		return err
+	}
+	for set, datas := range ft.banEntries(ip, scope) {
+		for _, data := range datas {
+			if err := f.set.Del(ctx, set, data, ipset.WithExist()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (f *defaultBlocker) WhiteIP(ctx context.Context, ip string) error {
-	return f.set.Add(ctx, f.getWhiteSet(), ip, ipset.WithExist())
+	ft, err := f.familyOf(ip)
+	if err != nil {
+		return err
+	}
+	return f.set.Add(ctx, ft.whiteSet, ip, ipset.WithExist())
 }
 
 func (f *defaultBlocker) UnWhiteIP(ctx context.Context, ip string) error {
-	return f.set.Del(ctx, f.getWhiteSet(), ip, ipset.WithExist())
+	ft, err := f.familyOf(ip)
+	if err != nil {
+		return err
+	}
+	return f.set.Del(ctx, ft.whiteSet, ip, ipset.WithExist())
+}
+
+func (f *defaultBlocker) Stats(ctx context.Context) ([]*SetStat, error) {
+	rs := make([]*SetStat, 0, 10)
+	for _, ft := range f.families() {
+		for _, set := range ft.sets() {
+			header, _, err := f.set.List(ctx, set, ipset.WithTerse())
+			if err != nil {
+				return nil, fmt.Errorf("list ip set:%s failed, err:%w", set, err)
+			}
+			rs = append(rs, &SetStat{Name: set, Entries: header.Numentries, MaxEntries: header.Maxelem})
+		}
+	}
+	return rs, nil
+}
+
+func (f *defaultBlocker) EntriesOf(ip string, scope *BanScope) (map[string]int, error) {
+	ft, err := f.familyOf(ip)
+	if err != nil {
+		return nil, err
+	}
+	rs := make(map[string]int, 2)
+	for set, datas := range ft.banEntries(ip, scope) {
+		rs[set] = len(datas)
+	}
+	return rs, nil
+}
+
+func (f *defaultBlocker) Repair(ctx context.Context) (*Drift, error) {
+	rs := &Drift{}
+	for _, ft := range f.families() {
+		if err := f.repairFamily(ctx, ft, rs); err != nil {
+			return nil, fmt.Errorf("repair family:%s failed, err:%w", ft.family, err)
+		}
+	}
+	return rs, nil
+}
+
+func (f *defaultBlocker) repairFamily(ctx context.Context, ft *familyTable, rs *Drift) error {
+	for _, set := range ft.sets() {
+		if _, _, err := f.set.List(ctx, set, ipset.WithTerse()); err != nil {
+			rs.add(ctx, DriftKindSet, set)
+			rs.NeedRebuild = true
+		}
+	}
+	if rs.NeedRebuild { //集合中的数据已经丢失, 由调用方整体重建
+		return nil
+	}
+	if err := f.repairBaseChain(ctx, ft, rs); err != nil {
+		return err
+	}
+	for _, src := range []string{defaultInputChain, defaultForwardChain, defaultDockerUserChain} {
+		if err := f.repairJump(ctx, ft, src, rs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *defaultBlocker) repairBaseChain(ctx context.Context, ft *familyTable, rs *Drift) error {
+	table := defaultFilterTable
+	chain := defaultCageChain
+	ok, err := ft.ipt.ChainExists(table, chain)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		rs.add(ctx, DriftKindChain, string(ft.family)+"/"+chain)
+		return f.ensureBaseChain(ctx, ft)
+	}
+	rules := f.baseRules(ft)
+	lst, err := ft.ipt.List(table, chain)
+	if err != nil {
+		return err
+	}
+	intact := len(lst) == len(rules)+1 //首行为链定义(-N)
+	for _, rule := range rules {
+		if !intact {
+			break
+		}
+		exist, err := ft.ipt.Exists(table, chain, rule.args...)
+		if err != nil {
+			return err
+		}
+		intact = exist
+	}
+	if intact {
+		return nil
+	}
+	rs.add(ctx, DriftKindRule, string(ft.family)+"/"+chain)
+	//规则顺序与数量都需要保证, 直接清空后按序重建
+	if err := ft.ipt.ClearChain(table, chain); err != nil {
+		return err
+	}
+	return f.ensureBaseChain(ctx, ft)
+}
+
+// repairJump 跳转规则需要位于源链的第一条
+func (f *defaultBlocker) repairJump(ctx context.Context, ft *familyTable, src string, rs *Drift) error {
+	table := defaultFilterTable
+	chain := defaultCageChain
+	ok, err := ft.ipt.ChainExists(table, src)
+	if err != nil {
+		return err
+	}
+	if ok {
+		lst, err := ft.ipt.List(table, src)
+		if err != nil {
+			return err
+		}
+		expect := fmt.Sprintf("-A %s -j %s", src, chain)
+		for _, line := range lst {
+			if !strings.HasPrefix(line, "-A ") {
+				continue
+			}
+			if line == expect {
+				return nil
+			}
+			break
+		}
+	}
+	rs.add(ctx, DriftKindJump, string(ft.family)+"/"+src)
+	if err := ft.ipt.DeleteIfExists(table, src, "-j", chain); err != nil && !strings.Contains(err.Error(), "does not exist") {
+		return err
+	}
+	if src == defaultDockerUserChain {
+		return f.ensureDockerChain(ctx, ft)
+	}
+	return f.ensureJumpChain(ctx, ft, src)
 }
@@ -0,0 +1,104 @@
+package blocker
+
+import (
+	"ip-blackcage/ipset"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testFamilyTable() *familyTable {
+	return &familyTable{family: ipset.FamilyInet6, blackSet: defaultBlackSet6, whiteSet: defaultWhiteSet6,
+		tcpSet: defaultTCPSet6, udpSet: defaultUDPSet6, portSet: defaultPortSet6}
+}
+
+func TestBanRules(t *testing.T) {
+	ft := testFamilyTable()
+	f := &defaultBlocker{c: applyOpts()}
+	rules := f.baseRules(ft)
+	assert.Equal(t, 7, len(rules))
+	assert.Equal(t, "-m set --match-set ip-blackcage-blacklist6-set src -j DROP", strings.Join(rules[2].args, " "))
+	assert.Equal(t, "-p tcp -m set --match-set ip-blackcage-tcp6-set src -j DROP", strings.Join(rules[3].args, " "))
+	assert.Equal(t, "-m set --match-set ip-blackcage-port6-set src,dst -j DROP", strings.Join(rules[5].args, " "))
+
+	f = &defaultBlocker{c: applyOpts(WithBanAction(ActionReject))}
+	rules = f.banRules(ft)
+	assert.Equal(t, 6, len(rules))
+	assert.Equal(t, "-p tcp -m set --match-set ip-blackcage-blacklist6-set src -j REJECT --reject-with tcp-reset", strings.Join(rules[0].args, " "))
+	assert.Equal(t, "-m set --match-set ip-blackcage-blacklist6-set src -j REJECT --reject-with icmp6-port-unreachable", strings.Join(rules[1].args, " "))
+	assert.Equal(t, "-p tcp -m set --match-set ip-blackcage-tcp6-set src -j REJECT --reject-with tcp-reset", strings.Join(rules[2].args, " "))
+	assert.Equal(t, "-p udp -m set --match-set ip-blackcage-udp6-set src -j REJECT --reject-with icmp6-port-unreachable", strings.Join(rules[3].args, " "))
+
+	f = &defaultBlocker{c: applyOpts(WithBanAction(ActionTarpit), WithTarpitRate(5))}
+	rules = f.banRules(ft)
+	assert.Equal(t, 8, len(rules))
+	assert.Contains(t, strings.Join(rules[0].args, " "), "--hashlimit-upto 5/minute --hashlimit-burst 5 --hashlimit-mode srcip --hashlimit-name bc-tarpit6 -j RETURN")
+	assert.Equal(t, "-m set --match-set ip-blackcage-blacklist6-set src -j DROP", strings.Join(rules[1].args, " "))
+}
+
+func TestBanEntries(t *testing.T) {
+	ft := testFamilyTable()
+	assert.Equal(t, map[string][]string{defaultBlackSet6: {"::1"}}, ft.banEntries("::1", nil))
+	assert.Equal(t, map[string][]string{defaultTCPSet6: {"::1"}}, ft.banEntries("::1", &BanScope{Name: "tcp", Protocol: ProtocolTCP}))
+	assert.Equal(t, map[string][]string{defaultPortSet6: {"::1,tcp:22", "::1,tcp:80", "::1,udp:22", "::1,udp:80"}},
+		ft.banEntries("::1", &BanScope{Name: "web", Ports: []uint16{22, 80}}))
+}
+
+func TestValidateBanScope(t *testing.T) {
+	assert.NoError(t, (&BanScope{Name: "ssh", Protocol: ProtocolTCP, Ports: []uint16{22}}).Validate())
+	assert.Error(t, (&BanScope{Name: "empty"}).Validate())
+	assert.Error(t, (&BanScope{Name: "icmp", Protocol: "icmp"}).Validate())
+}
+
+func TestValidateBanAction(t *testing.T) {
+	assert.NoError(t, applyOpts().validate())
+	assert.Error(t, applyOpts(WithBanAction("accept")).validate())
+}
+
+func TestSetUsage(t *testing.T) {
+	ft := testFamilyTable()
+	u := NewSetUsage([]*SetStat{
+		{Name: defaultBlackSet6, Entries: 1, MaxEntries: 4},
+		{Name: defaultPortSet6, Entries: 0, MaxEntries: 4},
+		{Name: defaultWhiteSet6, Entries: 100},
+	})
+	entriesOf := func(ip string, scope *BanScope) map[string]int {
+		rs := make(map[string]int)
+		for set, datas := range ft.banEntries(ip, scope) {
+			rs[set] = len(datas)
+		}
+		return rs
+	}
+	web := &BanScope{Name: "web", Ports: []uint16{80, 443}}
+	//2个端口*2个协议, 正好占满端口集合
+	entries := entriesOf("::1", web)
+	_, ok := u.Fits(entries)
+	assert.True(t, ok)
+	u.Add(entries, 1)
+	//端口集合已满, 即使封禁数远小于容量也需要拒绝
+	set, ok := u.Fits(entriesOf("::2", &BanScope{Name: "ssh", Protocol: ProtocolTCP, Ports: []uint16{22}}))
+	assert.False(t, ok)
+	assert.Equal(t, defaultPortSet6, set)
+	_, ok = u.Fits(entriesOf("::2", nil))
+	assert.True(t, ok)
+	name, ratio := u.MaxRatio()
+	assert.Equal(t, defaultPortSet6, name)
+	assert.Equal(t, 1.0, ratio)
+	u.Add(entries, -1)
+	_, ok = u.Fits(entriesOf("::2", web))
+	assert.True(t, ok)
+}
+
+func TestHeaderMatches(t *testing.T) {
+	timeout := uint64(0)
+	h := &ipset.Header{Family: "inet", Maxelem: 100000, Timeout: &timeout}
+	assert.True(t, headerMatches(h, ipset.FamilyInet, 100000, true))
+	assert.True(t, headerMatches(h, ipset.FamilyInet, 0, true))
+	assert.False(t, headerMatches(h, ipset.FamilyInet, 200000, true)) //容量调整
+	assert.False(t, headerMatches(h, ipset.FamilyInet, 100000, false))
+	assert.False(t, headerMatches(h, ipset.FamilyInet6, 100000, true))
+	h.Timeout = nil
+	assert.True(t, headerMatches(h, ipset.FamilyInet, 100000, false))
+	assert.False(t, headerMatches(h, ipset.FamilyInet, 100000, true))
+}
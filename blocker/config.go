@@ -1,7 +1,24 @@
 package blocker
 
+import "fmt"
+
+// 命中黑名单后的处理方式
+const (
+	ActionDrop   = "drop"   //直接丢弃
+	ActionReject = "reject" //tcp回复rst, 其他协议回复端口不可达, 看起来与端口未开放一致
+	ActionTarpit = "tarpit" //按来源ip限速, 仅放行少量报文, 其余丢弃, 拖慢扫描
+)
+
+const (
+	defaultTarpitRate = 3 //每个来源ip每分钟放行的报文数
+)
+
 type config struct {
-	cageSize uint64
+	cageSize    uint64
+	ipsetDriver string
+	persistent  bool
+	banAction   string
+	tarpitRate  uint32
 }
 
 type Option func(c *config)
@@ -12,10 +29,54 @@ func WithCageSize(sz uint64) Option {
 	}
 }
 
+// WithIPSetDriver iptables后端操作ipset的方式, 可选auto/netlink/exec
+func WithIPSetDriver(driver string) Option {
+	return func(c *config) {
+		c.ipsetDriver = driver
+	}
+}
+
+// WithPersistent 启动时不再清理已有的规则, 而是原地校正链/规则并整体替换集合内容, 避免重启期间规则失效
+func WithPersistent(v bool) Option {
+	return func(c *config) {
+		c.persistent = v
+	}
+}
+
+// WithBanAction 命中黑名单后的处理方式, 可选drop/reject/tarpit, 默认drop
+func WithBanAction(action string) Option {
+	return func(c *config) {
+		if len(action) > 0 {
+			c.banAction = action
+		}
+	}
+}
+
+// WithTarpitRate tarpit模式下每个来源ip每分钟放行的报文数
+func WithTarpitRate(n uint32) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.tarpitRate = n
+		}
+	}
+}
+
 func applyOpts(opts ...Option) *config {
-	c := &config{}
+	c := &config{
+		banAction:  ActionDrop,
+		tarpitRate: defaultTarpitRate,
+	}
 	for _, opt := range opts {
 		opt(c)
 	}
 	return c
 }
+
+func (c *config) validate() error {
+	switch c.banAction {
+	case ActionDrop, ActionReject, ActionTarpit:
+		return nil
+	default:
+		return fmt.Errorf("unsupported ban action:%s", c.banAction)
+	}
+}
@@ -0,0 +1,31 @@
+package blocker
+
+import (
+	"context"
+	"ip-blackcage/metrics"
+
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+// 漂移类型
+const (
+	DriftKindTable = "table"
+	DriftKindSet   = "set"
+	DriftKindChain = "chain"
+	DriftKindRule  = "rule"
+	DriftKindJump  = "jump"
+)
+
+// Drift 一次巡检中发现的规则漂移
+type Drift struct {
+	Items []string
+	// NeedRebuild 集合/表已经丢失, 其中的元素无法在blocker内恢复, 需要调用方重新Init
+	NeedRebuild bool
+}
+
+func (d *Drift) add(ctx context.Context, kind string, detail string) {
+	d.Items = append(d.Items, kind+":"+detail)
+	metrics.FirewallDrift.WithLabelValues(kind).Inc()
+	logutil.GetLogger(ctx).Warn("firewall drift detected", zap.String("kind", kind), zap.String("detail", detail))
+}
@@ -0,0 +1,651 @@
+package blocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ip-blackcage/utils"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/xxxsen/common/logutil"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultNftTable         = "ip-blackcage"
+	defaultNftBlackSet      = "blacklist"
+	defaultNftWhiteSet      = "whitelist"
+	defaultNftBlackSet6     = "blacklist6"
+	defaultNftWhiteSet6     = "whitelist6"
+	defaultNftCageChain     = "cage"
+	defaultNftInputChain    = "input"
+	defaultNftForwardChain  = "forward"
+	defaultNftElemBatch     = 1024
+	defaultNftTarpitTimeout = 10 * time.Minute
+)
+
+var errNftScopeNotSupported = errors.New("ban scope not supported by nftables backend")
+
+// nftSetPair 同一用途的ipv4/ipv6集合
+type nftSetPair struct {
+	v4 *nftables.Set
+	v6 *nftables.Set
+}
+
+func (p *nftSetPair) pick(ip string) (*nftables.Set, error) {
+	ok, err := utils.IsIPv4(ip)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return p.v4, nil
+	}
+	return p.v6, nil
+}
+
+type nftBlocker struct {
+	mu    sync.Mutex
+	conn  *nftables.Conn
+	c     *config
+	table *nftables.Table
+	black *nftSetPair
+	white *nftSetPair
+}
+
+// NewNftBlocker 创建基于nftables的blocker, 通过netlink直接下发规则, 不依赖iptables/ipset命令
+func NewNftBlocker(opts ...Option) (IBlocker, error) {
+	c := applyOpts(opts...)
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	conn, err := nftables.New(nftables.AsLasting())
+	if err != nil {
+		return nil, fmt.Errorf("open nftables conn failed, err:%w", err)
+	}
+	table := &nftables.Table{
+		Name:   defaultNftTable,
+		Family: nftables.TableFamilyINet,
+	}
+	return &nftBlocker{
+		conn:  conn,
+		c:     c,
+		table: table,
+		black: newNftSetPair(table, defaultNftBlackSet, defaultNftBlackSet6, true),
+		white: newNftSetPair(table, defaultNftWhiteSet, defaultNftWhiteSet6, false),
+	}, nil
+}
+
+func newNftSetPair(table *nftables.Table, name4 string, name6 string, withTimeout bool) *nftSetPair {
+	return &nftSetPair{
+		v4: &nftables.Set{
+			Table:      table,
+			Name:       name4,
+			KeyType:    nftables.TypeIPAddr,
+			Interval:   true,
+			HasTimeout: withTimeout,
+		},
+		v6: &nftables.Set{
+			Table:      table,
+			Name:       name6,
+			KeyType:    nftables.TypeIP6Addr,
+			Interval:   true,
+			HasTimeout: withTimeout,
+		},
+	}
+}
+
+// newNftTarpitSet tarpit模式下记录各来源ip限速状态的动态集合
+func newNftTarpitSet(table *nftables.Table, black *nftables.Set) *nftables.Set {
+	return &nftables.Set{
+		Table:      table,
+		Name:       black.Name + "-tarpit",
+		KeyType:    black.KeyType,
+		Dynamic:    true,
+		HasTimeout: true,
+		Timeout:    defaultNftTarpitTimeout,
+	}
+}
+
+func (f *nftBlocker) tableExists() (bool, error) {
+	tables, err := f.conn.ListTablesOfFamily(f.table.Family)
+	if err != nil {
+		return false, err
+	}
+	for _, t := range tables {
+		if t.Name == f.table.Name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *nftBlocker) buildElements(bans []*BanItem) ([]nftables.SetElement, error) {
+	items := make([]*ipInterval, 0, len(bans))
+	for _, ban := range bans {
+		item, err := parseIPInterval(ban.IP)
+		if err != nil {
+			return nil, err
+		}
+		item.timeout = clampTimeout(ban.Timeout)
+		items = append(items, item)
+	}
+	items = dedupIPIntervals(items)
+	rs := make([]nftables.SetElement, 0, 2*len(items))
+	for _, item := range items {
+		rs = append(rs, nftables.SetElement{Key: item.start, Timeout: item.timeout})
+		if item.end != nil {
+			rs = append(rs, nftables.SetElement{Key: item.end, IntervalEnd: true, Timeout: item.timeout})
+		}
+	}
+	return rs, nil
+}
+
+func (f *nftBlocker) fillSet(set *nftables.Set, items []*BanItem) error {
+	elems, err := f.buildElements(items)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(elems); {
+		end := start + defaultNftElemBatch
+		if end > len(elems) {
+			end = len(elems)
+		}
+		//区间的起止元素不能拆到两个批次里
+		if end < len(elems) && elems[end].IntervalEnd {
+			end++
+		}
+		if err := f.conn.SetAddElements(set, elems[start:end]); err != nil {
+			return err
+		}
+		if err := f.conn.Flush(); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// lookupExprs 源地址命中集合, 命中后寄存器1中保存的是源地址
+func (f *nftBlocker) lookupExprs(set *nftables.Set) []expr.Any {
+	//ip saddr / ip6 saddr 在网络层头部中的偏移及长度
+	proto, offset, length := byte(unix.NFPROTO_IPV4), uint32(12), uint32(4)
+	if set.KeyType.Name == nftables.TypeIP6Addr.Name {
+		proto, offset, length = unix.NFPROTO_IPV6, 8, 16
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	}
+}
+
+func (f *nftBlocker) matchSetRule(chain *nftables.Chain, set *nftables.Set, verdict expr.VerdictKind) *nftables.Rule {
+	return f.newRule(chain, f.lookupExprs(set), &expr.Verdict{Kind: verdict})
+}
+
+func (f *nftBlocker) newRule(chain *nftables.Chain, exprs []expr.Any, tail ...expr.Any) *nftables.Rule {
+	return &nftables.Rule{
+		Table: f.table,
+		Chain: chain,
+		Exprs: append(append([]expr.Any{}, exprs...), tail...),
+	}
+}
+
+// banRules 命中黑名单后的处理规则, 与配置的处理方式对应
+func (f *nftBlocker) banRules(chain *nftables.Chain, set *nftables.Set, tarpit *nftables.Set) []*nftables.Rule {
+	lookup := f.lookupExprs(set)
+	switch f.c.banAction {
+	case ActionReject:
+		tcp := append([]expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 2, Data: []byte{unix.IPPROTO_TCP}},
+		}, lookup...)
+		return []*nftables.Rule{
+			f.newRule(chain, tcp, &expr.Reject{Type: unix.NFT_REJECT_TCP_RST}),
+			f.newRule(chain, lookup, &expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_PORT_UNREACH}),
+		}
+	case ActionTarpit:
+		//等同于 update @tarpit { ip saddr limit rate N/minute } accept, 超出限速时dynset中断当前规则, 由下一条规则丢弃
+		limit := &expr.Dynset{
+			SrcRegKey: 1,
+			SetName:   tarpit.Name,
+			SetID:     tarpit.ID,
+			Operation: uint32(unix.NFT_DYNSET_OP_UPDATE),
+			Exprs: []expr.Any{
+				&expr.Limit{Type: expr.LimitTypePkts, Rate: uint64(f.c.tarpitRate), Unit: expr.LimitTimeMinute, Burst: f.c.tarpitRate},
+			},
+		}
+		return []*nftables.Rule{
+			f.newRule(chain, lookup, limit, &expr.Verdict{Kind: expr.VerdictAccept}),
+			f.newRule(chain, lookup, &expr.Verdict{Kind: expr.VerdictDrop}),
+		}
+	default:
+		return []*nftables.Rule{f.newRule(chain, lookup, &expr.Verdict{Kind: expr.VerdictDrop})}
+	}
+}
+
+// cageRuleCount cage链中的规则数: 2条白名单 + 1条已建立连接 + 2个协议族的黑名单处理规则
+func (f *nftBlocker) cageRuleCount() int {
+	switch f.c.banAction {
+	case ActionReject, ActionTarpit:
+		return 3 + 2*2
+	default:
+		return 3 + 2
+	}
+}
+
+func (f *nftBlocker) establishedRule(chain *nftables.Chain) *nftables.Rule {
+	return &nftables.Rule{
+		Table: f.table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	}
+}
+
+func (f *nftBlocker) addHookChain(cage *nftables.Chain, name string, hook *nftables.ChainHook) {
+	policy := nftables.ChainPolicyAccept
+	chain := f.conn.AddChain(&nftables.Chain{
+		Name:     name,
+		Table:    f.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  hook,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+	f.conn.AddRule(&nftables.Rule{
+		Table: f.table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: cage.Name},
+		},
+	})
+}
+
+func (f *nftBlocker) ensureTable() error {
+	f.conn.AddTable(f.table)
+	f.black = newNftSetPair(f.table, defaultNftBlackSet, defaultNftBlackSet6, true)
+	f.white = newNftSetPair(f.table, defaultNftWhiteSet, defaultNftWhiteSet6, false)
+	for _, set := range []*nftables.Set{f.white.v4, f.white.v6, f.black.v4, f.black.v6} {
+		if err := f.conn.AddSet(set, nil); err != nil {
+			return fmt.Errorf("add set:%s failed, err:%w", set.Name, err)
+		}
+	}
+	cage := f.conn.AddChain(&nftables.Chain{
+		Name:  defaultNftCageChain,
+		Table: f.table,
+	})
+	f.conn.AddRule(f.matchSetRule(cage, f.white.v4, expr.VerdictReturn))
+	f.conn.AddRule(f.matchSetRule(cage, f.white.v6, expr.VerdictReturn))
+	f.conn.AddRule(f.establishedRule(cage))
+	for _, set := range []*nftables.Set{f.black.v4, f.black.v6} {
+		var tarpit *nftables.Set
+		if f.c.banAction == ActionTarpit {
+			tarpit = newNftTarpitSet(f.table, set)
+			if err := f.conn.AddSet(tarpit, nil); err != nil {
+				return fmt.Errorf("add set:%s failed, err:%w", tarpit.Name, err)
+			}
+		}
+		for _, rule := range f.banRules(cage, set, tarpit) {
+			f.conn.AddRule(rule)
+		}
+	}
+	f.addHookChain(cage, defaultNftInputChain, nftables.ChainHookInput)
+	f.addHookChain(cage, defaultNftForwardChain, nftables.ChainHookForward)
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("create nft table failed, err:%w", err)
+	}
+	return nil
+}
+
+func (f *nftBlocker) Destroy(_ context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ok, err := f.tableExists()
+	if err != nil {
+		return fmt.Errorf("list nft table failed, err:%w", err)
+	}
+	if !ok {
+		return nil
+	}
+	f.conn.DelTable(f.table)
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("delete nft table failed, err:%w", err)
+	}
+	return nil
+}
+
+func (f *nftBlocker) Init(ctx context.Context, blackIps []*BanItem, whiteIps []string) error {
+	for _, item := range blackIps {
+		if item.Scope != nil {
+			return fmt.Errorf("init ip:%s failed, err:%w", item.IP, errNftScopeNotSupported)
+		}
+	}
+	if f.c.persistent {
+		ok, err := f.reloadSets(ctx, blackIps, whiteIps)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		logutil.GetLogger(ctx).Warn("nft table not intact, rebuild it")
+	}
+	if err := f.Destroy(ctx); err != nil { //先进行预处理
+		return fmt.Errorf("destroy before init failed, err:%w", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.ensureTable(); err != nil {
+		return err
+	}
+	if err := f.fillSetPair(f.white, toBanItems(whiteIps)); err != nil {
+		return fmt.Errorf("ensure white ip set failed, err:%w", err)
+	}
+	if err := f.fillSetPair(f.black, blackIps); err != nil {
+		return fmt.Errorf("ensure black ip set failed, err:%w", err)
+	}
+	return nil
+}
+
+// reloadSets 表结构完整时, 在同一个事务中清空并重新填充全部集合, 替换过程中规则始终生效
+// 表结构不完整时返回false, 由调用方重建
+func (f *nftBlocker) reloadSets(ctx context.Context, blackIps []*BanItem, whiteIps []string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ok, err := f.tableExists()
+	if err != nil {
+		return false, fmt.Errorf("list nft table failed, err:%w", err)
+	}
+	if !ok {
+		return false, nil
+	}
+	drift, err := f.detectDrift(ctx)
+	if err != nil {
+		return false, err
+	}
+	if drift.NeedRebuild {
+		return false, nil
+	}
+	fills := []struct {
+		p     *nftSetPair
+		items []*BanItem
+	}{
+		{f.white, toBanItems(whiteIps)},
+		{f.black, blackIps},
+	}
+	for _, item := range fills {
+		ips4, ips6, err := splitBanItemsByFamily(item.items)
+		if err != nil {
+			return false, err
+		}
+		if err := f.replaceSet(item.p.v4, ips4); err != nil {
+			return false, err
+		}
+		if err := f.replaceSet(item.p.v6, ips6); err != nil {
+			return false, err
+		}
+	}
+	if err := f.conn.Flush(); err != nil {
+		return false, fmt.Errorf("reload nft sets failed, err:%w", err)
+	}
+	return true, nil
+}
+
+// replaceSet 只将清空及填充操作加入当前批次, 由调用方统一提交
+func (f *nftBlocker) replaceSet(set *nftables.Set, items []*BanItem) error {
+	elems, err := f.buildElements(items)
+	if err != nil {
+		return err
+	}
+	f.conn.FlushSet(set)
+	for start := 0; start < len(elems); {
+		end := start + defaultNftElemBatch
+		if end > len(elems) {
+			end = len(elems)
+		}
+		if end < len(elems) && elems[end].IntervalEnd {
+			end++
+		}
+		if err := f.conn.SetAddElements(set, elems[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+func (f *nftBlocker) fillSetPair(p *nftSetPair, items []*BanItem) error {
+	ips4, ips6, err := splitBanItemsByFamily(items)
+	if err != nil {
+		return err
+	}
+	if err := f.fillSet(p.v4, ips4); err != nil {
+		return err
+	}
+	if err := f.fillSet(p.v6, ips6); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (f *nftBlocker) addElements(set *nftables.Set, item *BanItem) error {
+	elems, err := f.buildElements([]*BanItem{item})
+	if err != nil {
+		return err
+	}
+	if item.Timeout > 0 {
+		//内核不会刷新已存在元素的超时, 先删后加, 两个操作处于同一批次中
+		if err := f.conn.SetDeleteElements(set, elems); err != nil {
+			return err
+		}
+		if err := f.conn.SetAddElements(set, elems); err != nil {
+			return err
+		}
+		err := f.conn.Flush()
+		if !errors.Is(err, syscall.ENOENT) {
+			return err
+		}
+	}
+	if err := f.conn.SetAddElements(set, elems); err != nil {
+		return err
+	}
+	err = f.conn.Flush()
+	//与ipset的-exist保持一致, 重复添加的元素不视为错误
+	if errors.Is(err, syscall.EEXIST) {
+		return nil
+	}
+	return err
+}
+
+func (f *nftBlocker) delElements(set *nftables.Set, ip string) error {
+	elems, err := f.buildElements([]*BanItem{{IP: ip}})
+	if err != nil {
+		return err
+	}
+	if err := f.conn.SetDeleteElements(set, elems); err != nil {
+		return err
+	}
+	err = f.conn.Flush()
+	if !errors.Is(err, syscall.ENOENT) {
+		return err
+	}
+	//元素不存在时, 只有ip确实已不在集合中(例如已超时)才视为成功, 被其他区间覆盖时删除并未生效
+	entry, ok, lerr := f.lookupElement(set, ip)
+	if lerr != nil {
+		return fmt.Errorf("lookup ip:%s in set:%s failed, err:%w", ip, set.Name, lerr)
+	}
+	if ok {
+		return fmt.Errorf("ip:%s is covered by element:%s of set:%s, err:%w", ip, entry, set.Name, err)
+	}
+	return nil
+}
+
+// lookupElement 返回集合中包含ip的区间
+func (f *nftBlocker) lookupElement(set *nftables.Set, ip string) (string, bool, error) {
+	target, err := parseIPInterval(ip)
+	if err != nil {
+		return "", false, err
+	}
+	elems, err := f.conn.GetSetElements(set)
+	if err != nil {
+		return "", false, err
+	}
+	for _, item := range elementIntervals(elems) {
+		if covers(item, target) {
+			return item.String(), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func (f *nftBlocker) updateSet(p *nftSetPair, item *BanItem, add bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	set, err := p.pick(item.IP)
+	if err != nil {
+		return err
+	}
+	if add {
+		return f.addElements(set, item)
+	}
+	return f.delElements(set, item.IP)
+}
+
+func (f *nftBlocker) BanIP(_ context.Context, ip string, scope *BanScope, timeout time.Duration) error {
+	if scope != nil {
+		return errNftScopeNotSupported
+	}
+	return f.updateSet(f.black, &BanItem{IP: ip, Timeout: timeout}, true)
+}
+
+func (f *nftBlocker) UnBanIP(_ context.Context, ip string, scope *BanScope) error {
+	if scope != nil {
+		return errNftScopeNotSupported
+	}
+	return f.updateSet(f.black, &BanItem{IP: ip}, false)
+}
+
+func (f *nftBlocker) WhiteIP(_ context.Context, ip string) error {
+	return f.updateSet(f.white, &BanItem{IP: ip}, true)
+}
+
+func (f *nftBlocker) UnWhiteIP(_ context.Context, ip string) error {
+	return f.updateSet(f.white, &BanItem{IP: ip}, false)
+}
+
+func (f *nftBlocker) Stats(_ context.Context) ([]*SetStat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rs := make([]*SetStat, 0, 4)
+	for _, set := range []*nftables.Set{f.black.v4, f.white.v4, f.black.v6, f.white.v6} {
+		elems, err := f.conn.GetSetElements(set)
+		if err != nil {
+			return nil, fmt.Errorf("list nft set:%s failed, err:%w", set.Name, err)
+		}
+		cnt := 0
+		for _, elem := range elems {
+			if elem.IntervalEnd { //区间的结束标记不计入元素数
+				continue
+			}
+			cnt++
+		}
+		rs = append(rs, &SetStat{Name: set.Name, Entries: cnt})
+	}
+	return rs, nil
+}
+
+// EntriesOf nftables的集合未设置容量上限, 这里只用于统计
+func (f *nftBlocker) EntriesOf(ip string, scope *BanScope) (map[string]int, error) {
+	if scope != nil {
+		return nil, errNftScopeNotSupported
+	}
+	set, err := f.black.pick(ip)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{set.Name: 1}, nil
+}
+
+// Repair nftables的规则都位于独立的表中, 任何部分丢失时都需要调用方整体重建
+func (f *nftBlocker) Repair(ctx context.Context) (*Drift, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.detectDrift(ctx)
+}
+
+func (f *nftBlocker) detectDrift(ctx context.Context) (*Drift, error) {
+	rs := &Drift{}
+	ok, err := f.tableExists()
+	if err != nil {
+		return nil, fmt.Errorf("list nft table failed, err:%w", err)
+	}
+	if !ok {
+		rs.add(ctx, DriftKindTable, f.table.Name)
+		rs.NeedRebuild = true
+		return rs, nil
+	}
+	sets, err := f.conn.GetSets(f.table)
+	if err != nil {
+		return nil, fmt.Errorf("list nft sets failed, err:%w", err)
+	}
+	existSets := make(map[string]struct{}, len(sets))
+	for _, set := range sets {
+		existSets[set.Name] = struct{}{}
+	}
+	for _, set := range []*nftables.Set{f.white.v4, f.white.v6, f.black.v4, f.black.v6} {
+		if _, ok := existSets[set.Name]; !ok {
+			rs.add(ctx, DriftKindSet, set.Name)
+			rs.NeedRebuild = true
+		}
+	}
+	chains, err := f.conn.ListChainsOfTableFamily(f.table.Family)
+	if err != nil {
+		return nil, fmt.Errorf("list nft chains failed, err:%w", err)
+	}
+	//入口链: 1条跳转
+	expectRules := map[string]int{
+		defaultNftCageChain:    f.cageRuleCount(),
+		defaultNftInputChain:   1,
+		defaultNftForwardChain: 1,
+	}
+	for _, chain := range chains {
+		if chain.Table.Name != f.table.Name {
+			continue
+		}
+		cnt, ok := expectRules[chain.Name]
+		if !ok {
+			continue
+		}
+		delete(expectRules, chain.Name)
+		rules, err := f.conn.GetRules(f.table, chain)
+		if err != nil {
+			return nil, fmt.Errorf("list nft rules of chain:%s failed, err:%w", chain.Name, err)
+		}
+		if len(rules) != cnt {
+			rs.add(ctx, DriftKindRule, chain.Name)
+			rs.NeedRebuild = true
+		}
+	}
+	for name := range expectRules {
+		rs.add(ctx, DriftKindChain, name)
+		rs.NeedRebuild = true
+	}
+	return rs, nil
+}
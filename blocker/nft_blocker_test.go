@@ -0,0 +1,76 @@
+package blocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// isEnvError 判断错误是否由运行环境不支持(无权限, 内核不支持nftables等)导致
+func isEnvError(err error) bool {
+	for _, errno := range []unix.Errno{unix.EPERM, unix.EACCES, unix.EPROTONOSUPPORT, unix.EAFNOSUPPORT, unix.EOPNOTSUPP} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// runInNetNS 在独立的网络命名空间中执行, 不影响本机的防火墙规则
+// fn返回的错误由运行环境导致时跳过测试, 其他错误视为失败
+func runInNetNS(t *testing.T, fn func() error) {
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		runtime.LockOSThread() //不解锁, goroutine退出时线程随之销毁, 避免其他goroutine进入该命名空间
+		if err = unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			err = fmt.Errorf("create net namespace failed, err:%w", err)
+			return
+		}
+		err = fn()
+	}()
+	<-done
+	if err == nil {
+		return
+	}
+	if isEnvError(err) {
+		t.Skipf("environment not supported, err:%v", err)
+	}
+	t.Fatal(err)
+}
+
+func TestNftUnBanAdjacentIP(t *testing.T) {
+	runInNetNS(t, func() error {
+		ctx := context.Background()
+		f, err := NewNftBlocker()
+		if err != nil {
+			return err
+		}
+		nft := f.(*nftBlocker)
+		if err := f.Init(ctx, []*BanItem{{IP: "1.2.3.4"}, {IP: "1.2.3.5"}}, nil); err != nil {
+			return fmt.Errorf("init nftables failed, err:%w", err)
+		}
+		defer f.Destroy(ctx)
+		assert.NoError(t, f.UnBanIP(ctx, "1.2.3.4", nil))
+		_, ok, err := nft.lookupElement(nft.black.v4, "1.2.3.4")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		entry, ok, err := nft.lookupElement(nft.black.v4, "1.2.3.5")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "1.2.3.5-1.2.3.6", entry)
+
+		//被网段覆盖的ip无法单独解封, 需要返回错误
+		assert.NoError(t, f.BanIP(ctx, "10.0.0.0/24", nil, 0))
+		assert.Error(t, f.UnBanIP(ctx, "10.0.0.1", nil))
+		//已不在集合中的ip重复解封不视为错误
+		assert.NoError(t, f.UnBanIP(ctx, "1.2.3.4", nil))
+		return nil
+	})
+}
@@ -0,0 +1,154 @@
+package blocker
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// ipInterval 表示一个左闭右开的地址区间[start, end), end为nil时表示区间一直延伸到地址空间末尾
+// timeout为0时表示区间永不过期
+type ipInterval struct {
+	start   net.IP
+	end     net.IP
+	timeout time.Duration
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+func (i *ipInterval) String() string {
+	if i.end == nil {
+		return i.start.String() + "-"
+	}
+	return i.start.String() + "-" + i.end.String()
+}
+
+func nextIP(ip net.IP) net.IP {
+	rs := make(net.IP, len(ip))
+	copy(rs, ip)
+	for i := len(rs) - 1; i >= 0; i-- {
+		rs[i]++
+		if rs[i] != 0 {
+			return rs
+		}
+	}
+	return nil //溢出
+}
+
+func parseIPInterval(s string) (*ipInterval, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip:%s", s)
+		}
+		ip = normalizeIP(ip)
+		return &ipInterval{start: ip, end: nextIP(ip)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr:%s, err:%w", s, err)
+	}
+	start := normalizeIP(ipnet.IP)
+	last := make(net.IP, len(start))
+	mask := ipnet.Mask
+	if len(mask) != len(start) {
+		mask = mask[len(mask)-len(start):]
+	}
+	for i := range start {
+		last[i] = start[i] | ^mask[i]
+	}
+	return &ipInterval{start: start, end: nextIP(last)}, nil
+}
+
+// dedupIPIntervals 移除重复及被其他区间完整覆盖的区间, 内核的interval set不允许插入相互重叠的元素
+// 相邻的区间保持独立, 否则单个ip的删除会因为找不到对应元素而失败, 且各元素会被迫共用同一个超时
+// ip与cidr之间只存在包含或者不相交两种关系, 因此不会出现部分重叠的区间
+func dedupIPIntervals(items []*ipInterval) []*ipInterval {
+	if len(items) == 0 {
+		return nil
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if c := bytes.Compare(items[i].start, items[j].start); c != 0 {
+			return c < 0
+		}
+		return endAfter(items[i].end, items[j].end) //起点相同时范围大的在前
+	})
+	rs := make([]*ipInterval, 0, len(items))
+	cur := items[0]
+	for _, item := range items[1:] {
+		if !covers(cur, item) {
+			rs = append(rs, cur)
+			cur = item
+			continue
+		}
+		if bytes.Equal(cur.start, item.start) && bytes.Equal(cur.end, item.end) { //完全相同的条目取较长的超时
+			cur.timeout = longerTimeout(cur.timeout, item.timeout)
+		}
+	}
+	rs = append(rs, cur)
+	return rs
+}
+
+// endAfter 区间终点a是否在b之后, nil表示地址空间末尾
+func endAfter(a, b net.IP) bool {
+	if a == nil || b == nil {
+		return a == nil && b != nil
+	}
+	return bytes.Compare(a, b) > 0
+}
+
+func covers(outer, inner *ipInterval) bool {
+	return bytes.Compare(inner.start, outer.start) >= 0 && !endAfter(inner.end, outer.end)
+}
+
+// longerTimeout 取较长的超时, 永久(0)优先
+func longerTimeout(a, b time.Duration) time.Duration {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// elementIntervals 将内核返回的区间起止元素还原为区间, 内核返回的元素顺序不固定, 需要先排序
+// 相邻区间的终点与起点键值相同, 排序时终点在前
+func elementIntervals(elems []nftables.SetElement) []*ipInterval {
+	sorted := make([]nftables.SetElement, len(elems))
+	copy(sorted, elems)
+	sort.Slice(sorted, func(i, j int) bool {
+		if c := bytes.Compare(sorted[i].Key, sorted[j].Key); c != 0 {
+			return c < 0
+		}
+		return sorted[i].IntervalEnd && !sorted[j].IntervalEnd
+	})
+	rs := make([]*ipInterval, 0, len(sorted)/2+1)
+	var cur *ipInterval
+	for _, elem := range sorted {
+		if !elem.IntervalEnd {
+			cur = &ipInterval{start: net.IP(elem.Key), timeout: elem.Timeout}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		cur.end = net.IP(elem.Key)
+		rs = append(rs, cur)
+		cur = nil
+	}
+	if cur != nil { //没有终点的区间延伸到地址空间末尾
+		rs = append(rs, cur)
+	}
+	return rs
+}
@@ -0,0 +1,63 @@
+package blocker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIPInterval(t *testing.T) {
+	item, err := parseIPInterval("1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", item.start.String())
+	assert.Equal(t, "1.2.3.5", item.end.String())
+
+	item, err = parseIPInterval("10.0.0.0/8")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.0", item.start.String())
+	assert.Equal(t, "11.0.0.0", item.end.String())
+
+	item, err = parseIPInterval("fe80::/10")
+	assert.NoError(t, err)
+	assert.Equal(t, "fe80::", item.start.String())
+	assert.Equal(t, "fec0::", item.end.String())
+
+	item, err = parseIPInterval("255.255.255.0/24")
+	assert.NoError(t, err)
+	assert.Nil(t, item.end)
+
+	_, err = parseIPInterval("1.2.3")
+	assert.Error(t, err)
+}
+
+func TestDedupIPIntervals(t *testing.T) {
+	items := make([]*ipInterval, 0, 6)
+	for _, s := range []string{"1.1.1.0/24", "1.1.1.5", "1.1.2.0/24", "2.2.2.2", "2.2.2.3", "2.2.2.2"} {
+		item, err := parseIPInterval(s)
+		assert.NoError(t, err)
+		items = append(items, item)
+	}
+	rs := dedupIPIntervals(items)
+	assert.Equal(t, 4, len(rs))
+	assert.Equal(t, "1.1.1.0-1.1.2.0", rs[0].String())
+	assert.Equal(t, "1.1.2.0-1.1.3.0", rs[1].String())
+	assert.Equal(t, "2.2.2.2-2.2.2.3", rs[2].String())
+	assert.Equal(t, "2.2.2.3-2.2.2.4", rs[3].String())
+}
+
+func TestElementIntervals(t *testing.T) {
+	elems := []nftables.SetElement{
+		{Key: net.ParseIP("1.1.1.2").To4(), IntervalEnd: true},
+		{Key: net.ParseIP("1.1.1.1").To4()},
+		{Key: net.ParseIP("1.1.1.3").To4(), IntervalEnd: true},
+		{Key: net.ParseIP("1.1.1.2").To4()},
+		{Key: net.ParseIP("255.0.0.0").To4()},
+	}
+	rs := elementIntervals(elems)
+	assert.Equal(t, 3, len(rs))
+	assert.Equal(t, "1.1.1.1-1.1.1.2", rs[0].String())
+	assert.Equal(t, "1.1.1.2-1.1.1.3", rs[1].String())
+	assert.Equal(t, "255.0.0.0-", rs[2].String())
+}
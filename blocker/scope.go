@@ -0,0 +1,53 @@
+package blocker
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// BanScope 封禁范围, 为nil时表示拦截来源ip的全部流量
+// 仅配置Protocol时拦截该协议的全部端口, 配置Ports时仅拦截对应端口, Protocol为空表示tcp/udp均拦截
+type BanScope struct {
+	Name     string
+	Protocol string
+	Ports    []uint16
+}
+
+func (s *BanScope) Validate() error {
+	if len(s.Name) == 0 {
+		return fmt.Errorf("no scope name found")
+	}
+	switch s.Protocol {
+	case "", ProtocolTCP, ProtocolUDP:
+	default:
+		return fmt.Errorf("unsupported protocol:%s in scope:%s", s.Protocol, s.Name)
+	}
+	if len(s.Protocol) == 0 && len(s.Ports) == 0 {
+		return fmt.Errorf("scope:%s has neither protocol nor ports", s.Name)
+	}
+	return nil
+}
+
+// Protocols 范围内被拦截的协议
+func (s *BanScope) Protocols() []string {
+	if len(s.Protocol) > 0 {
+		return []string{s.Protocol}
+	}
+	return []string{ProtocolTCP, ProtocolUDP}
+}
+
+// portEntries 端口范围在hash:net,port集合中的元素
+func (s *BanScope) portEntries(ip string) []string {
+	rs := make([]string, 0, 2*len(s.Ports))
+	for _, proto := range s.Protocols() {
+		for _, port := range s.Ports {
+			rs = append(rs, ip+","+proto+":"+strconv.Itoa(int(port)))
+		}
+	}
+	return rs
+}
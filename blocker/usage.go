@@ -0,0 +1,59 @@
+package blocker
+
+// SetUsage 各集合的元素数及容量, 由Stats的结果初始化
+// 两次Stats之间只累加写入的元素, 解封/超时释放的元素等到下一次Stats时再校正, 估算值只会偏大, 不会导致内核集合写满
+type SetUsage struct {
+	sets map[string]*SetStat
+}
+
+func NewSetUsage(stats []*SetStat) *SetUsage {
+	u := &SetUsage{sets: make(map[string]*SetStat, len(stats))}
+	for _, st := range stats {
+		cp := *st
+		u.sets[st.Name] = &cp
+	}
+	return u
+}
+
+// Fits 检查写入entries后各集合是否超出容量, 超出时返回第一个超出的集合
+func (u *SetUsage) Fits(entries map[string]int) (string, bool) {
+	for name, cnt := range entries {
+		st, ok := u.sets[name]
+		if !ok || st.MaxEntries == 0 {
+			continue
+		}
+		if st.Entries+cnt > st.MaxEntries {
+			return name, false
+		}
+	}
+	return "", true
+}
+
+// Add 按entries增加(sign为1)或者减少(sign为-1)各集合的元素数
+func (u *SetUsage) Add(entries map[string]int, sign int) {
+	for name, cnt := range entries {
+		st, ok := u.sets[name]
+		if !ok {
+			continue
+		}
+		st.Entries += sign * cnt
+		if st.Entries < 0 {
+			st.Entries = 0
+		}
+	}
+}
+
+// MaxRatio 返回使用率最高的集合及其使用率, 没有设置容量的集合不参与计算
+func (u *SetUsage) MaxRatio() (string, float64) {
+	var name string
+	var ratio float64
+	for _, st := range u.sets {
+		if st.MaxEntries == 0 {
+			continue
+		}
+		if r := float64(st.Entries) / float64(st.MaxEntries); r > ratio || len(name) == 0 {
+			name, ratio = st.Name, r
+		}
+	}
+	return name, ratio
+}
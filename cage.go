@@ -3,10 +3,19 @@ package ipblackcage
 import (
 	"context"
 	"fmt"
+	"ip-blackcage/blocker"
+	"ip-blackcage/conntrack"
 	"ip-blackcage/event"
 	"ip-blackcage/ipevent"
+	"ip-blackcage/ipmatch"
+	"ip-blackcage/logevent"
+	"ip-blackcage/metrics"
 	"ip-blackcage/model"
-	"ip-blackcage/utils"
+	"ip-blackcage/rule"
+	"ip-blackcage/userlist"
+	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/xxxsen/common/logutil"
@@ -27,11 +36,43 @@ var (
 		"192.88.99.0/24",
 		"224.0.0.0/4",
 	}
+	defaultIPv6LocalNetworkIPs = []string{
+		"::1/128",
+		"fe80::/10",
+		"fc00::/7",
+	}
+)
+
+const (
+	defaultReconcileInterval      = 10 * time.Minute
+	defaultTempWhiteCheckInterval = 30 * time.Second
+	defaultStatsInterval          = 1 * time.Minute
+	defaultDriftCheckInterval     = 1 * time.Minute
+	defaultStopTimeout            = 10 * time.Second
 )
 
+type userListChange struct {
+	black bool
+	diff  *userlist.Diff
+}
+
 type IPBlackCage struct {
-	c    *config
-	done chan bool
+	c          *config
+	done       chan bool
+	userList   chan *userListChange
+	actions    chan *cageAction
+	tempWhite  map[string]uint64           //临时白名单及其过期时间(毫秒), 仅在事件循环中访问
+	banned     map[string]uint64           //DB中未过期的黑名单及其过期时间(毫秒), 仅在事件循环中访问
+	refreshAt  map[string]uint64           //封禁时长超出内核上限的条目需要续期的时间(毫秒), 仅在事件循环中访问
+	usage      *blocker.SetUsage           //内核集合的使用量, 由统计流程定期校正, 仅在事件循环中访问
+	subnetHits map[string]map[string]int64 //各网段内最近被封禁的ip, 仅在事件循环中访问
+	white      ipmatch.IMatcher            //白名单索引, 仅在事件循环中更新
+	visits     map[string]*model.BlackIPVisit
+	history    map[historyKey]*historyRow //待落库的事件历史, 仅在事件循环中访问
+	started    bool
+	loopExit   chan struct{}
+	forceExit  chan struct{} //等待事件排空超时后, 强制事件循环退出
+	stopOnce   sync.Once
 }
 
 func New(opts ...Option) (*IPBlackCage, error) {
@@ -39,46 +80,129 @@ func New(opts ...Option) (*IPBlackCage, error) {
 	if c.filter == nil {
 		return nil, fmt.Errorf("no filter found")
 	}
-	if c.obs == nil {
+	if len(c.obs) == 0 {
 		return nil, fmt.Errorf("no observer found")
 	}
-	return &IPBlackCage{c: c, done: make(chan bool)}, nil
+	if len(c.overflowPolicy) == 0 {
+		c.overflowPolicy = OverflowReject
+	}
+	if err := validateOverflowPolicy(c.overflowPolicy); err != nil {
+		return nil, err
+	}
+	if c.subnet != nil {
+		if err := c.subnet.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &IPBlackCage{
+		c:          c,
+		done:       make(chan bool),
+		userList:   make(chan *userListChange, 16),
+		actions:    make(chan *cageAction, 16),
+		tempWhite:  make(map[string]uint64),
+		banned:     make(map[string]uint64),
+		refreshAt:  make(map[string]uint64),
+		history:    make(map[historyKey]*historyRow, defaultHistoryFlushSize),
+		subnetHits: make(map[string]map[string]int64),
+		white:      ipmatch.NewMatcher(),
+		visits:     make(map[string]*model.BlackIPVisit, defaultVisitFlushSize),
+		loopExit:   make(chan struct{}),
+		forceExit:  make(chan struct{}),
+	}, nil
+}
+
+// banDuration 根据历史被封禁次数选择本次的封禁时长, 返回0表示永久封禁
+func (bc *IPBlackCage) banDuration(offenses int64) time.Duration {
+	ladder := bc.c.banLadder
+	if len(ladder) == 0 {
+		return bc.c.banTime
+	}
+	if offenses >= int64(len(ladder)) {
+		offenses = int64(len(ladder)) - 1
+	}
+	return ladder[offenses]
+}
+
+// expireAtOf 读取记录的过期时间, 旧版本写入的记录没有过期时间, 沿用MTime + banTime的计算方式
+func (bc *IPBlackCage) expireAtOf(item *model.BlackCageTab) uint64 {
+	if item.ExpireAt != 0 {
+		return item.ExpireAt
+	}
+	return uint64(time.UnixMilli(int64(item.MTime)).Add(bc.c.banTime).UnixMilli())
 }
 
-func (bc *IPBlackCage) readBlackListFromDB(ctx context.Context) ([]string, error) {
-	dbIPList := make([]string, 0, 1024)
+func (bc *IPBlackCage) isExpired(item *model.BlackCageTab, now time.Time) bool {
+	return bc.expireAtOf(item) <= uint64(now.UnixMilli())
+}
+
+// remainBanTime 计算剩余的拦截时长, 返回0表示永久拦截
+func (bc *IPBlackCage) remainBanTime(item *model.BlackCageTab, now time.Time) time.Duration {
+	expireAt := bc.expireAtOf(item)
+	if expireAt == model.ExpireAtPermanent {
+		return 0
+	}
+	return time.UnixMilli(int64(expireAt)).Sub(now)
+}
+
+func (bc *IPBlackCage) readBlackListFromDB(ctx context.Context) ([]*blocker.BanItem, error) {
+	dbIPList := make([]*blocker.BanItem, 0, 1024)
+	banned := make(map[string]uint64, 1024)
+	bc.refreshAt = make(map[string]uint64)
 	//DB IP 列表
-	delims := uint64(time.Now().Add(-1 * bc.c.banTime).UnixMilli())
+	now := time.Now()
 	_, err := bc.c.ipDao.ScanBlackIP(ctx, 200, func(ctx context.Context, ips []*model.BlackCageTab) error {
 		for _, ip := range ips {
-			//仅提取满足条件的黑名单ip
-			if ip.MTime <= delims {
+			if ip.ExpireAt == 0 { //补齐旧记录的过期时间
+				if err := bc.c.ipDao.SetBlackIPExpire(ctx, ip.IP, bc.expireAtOf(ip)); err != nil {
+					return fmt.Errorf("fill expire_at for ip:%s failed, err:%w", ip.IP, err)
+				}
+			}
+			//仅提取未过期的黑名单ip, 过期的交由对账流程清理
+			if bc.isExpired(ip, now) {
 				continue
 			}
-			dbIPList = append(dbIPList, ip.IP)
+			remain := bc.remainBanTime(ip, now)
+			dbIPList = append(dbIPList, &blocker.BanItem{IP: ip.IP, Timeout: remain, Scope: bc.scopeOf(ctx, ip.Scope)})
+			banned[ip.IP] = bc.expireAtOf(ip)
+			bc.trackKernelTimeout(ip.IP, remain, now)
+			if len(ip.Scope) == 0 { //重启前的封禁同样计入网段合并的统计, 窗口外的记录由对账流程清理
+				bc.addSubnetHit(ip.IP, int64(ip.CTime))
+			}
 		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	bc.banned = banned
 	return dbIPList, nil
 }
 
-func (bc *IPBlackCage) readListFromFiles(lst []string) ([]string, error) {
-	rs := make([]string, 0, 1024)
-	for _, ipfile := range lst {
-		ips, err := utils.ReadIPListFromFile(ipfile)
-		if err != nil {
-			return nil, fmt.Errorf("read ip list from file:%s failed, err:%w", ipfile, err)
-		}
-		rs = append(rs, ips...)
+func (bc *IPBlackCage) readListFromWatcher(ctx context.Context, w userlist.IWatcher) ([]string, error) {
+	if w == nil {
+		return nil, nil
 	}
-	return rs, nil
+	return w.Load(ctx)
 }
 
 func (bc *IPBlackCage) readLocalNetworkList() ([]string, error) {
-	return defaultIPv4LocalNetworkIPs, nil
+	rs := make([]string, 0, len(defaultIPv4LocalNetworkIPs)+len(defaultIPv6LocalNetworkIPs))
+	rs = append(rs, defaultIPv4LocalNetworkIPs...)
+	rs = append(rs, defaultIPv6LocalNetworkIPs...)
+	return rs, nil
+}
+
+func (bc *IPBlackCage) isLocalNetworkEntry(entry string) bool {
+	if bc.c.disableLocalNetworkProtect {
+		return false
+	}
+	lst, _ := bc.readLocalNetworkList()
+	for _, item := range lst {
+		if item == entry {
+			return true
+		}
+	}
+	return false
 }
 
 func (bc *IPBlackCage) initCageChain(ctx context.Context) error {
@@ -86,11 +210,11 @@ func (bc *IPBlackCage) initCageChain(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("read db black ips failed, err:%w", err)
 	}
-	userBlackIPList, err := bc.readListFromFiles(bc.c.userBlackList)
+	userBlackIPList, err := bc.readListFromWatcher(ctx, bc.c.userBlackList)
 	if err != nil {
 		return fmt.Errorf("read user black ips failed, err:%w", err)
 	}
-	userWhiteIPList, err := bc.readListFromFiles(bc.c.userWhiteList)
+	userWhiteIPList, err := bc.readListFromWatcher(ctx, bc.c.userWhiteList)
 	if err != nil {
 		return fmt.Errorf("read user white ips failed, err:%w", err)
 	}
@@ -107,9 +231,12 @@ func (bc *IPBlackCage) initCageChain(ctx context.Context) error {
 		zap.Int("user_black_ips", len(userBlackIPList)),
 		zap.Int("user_white_ips", len(userWhiteIPList)),
 	)
-	blackList := make([]string, 0, len(dbBlackIPList)+len(userBlackIPList))
+	blackList := make([]*blocker.BanItem, 0, len(dbBlackIPList)+len(userBlackIPList))
 	blackList = append(blackList, dbBlackIPList...)
-	blackList = append(blackList, userBlackIPList...)
+	for _, ip := range userBlackIPList { //用户指定的黑名单永久生效
+		blackList = append(blackList, &blocker.BanItem{IP: ip})
+	}
+	bc.rebuildWhiteMatcher(ctx, userWhiteIPList, localNetworkList)
 	whiteList := make([]string, 0, len(userWhiteIPList)+len(localNetworkList))
 	whiteList = append(whiteList, userWhiteIPList...)
 	whiteList = append(whiteList, localNetworkList...)
@@ -120,69 +247,286 @@ func (bc *IPBlackCage) initCageChain(ctx context.Context) error {
 	return nil
 }
 
-func (bc *IPBlackCage) checkShouldBanIPByRules(_ context.Context, _ *ipevent.IPEventData) bool {
-	//TODO: 在这里添加其他杂七杂八的规则
-	return true
+// checkShouldBanIPByRules 判断是否需要封禁, 需要封禁时同时返回触发封禁的规则, 该事件类型未配置规则时规则为nil
+func (bc *IPBlackCage) checkShouldBanIPByRules(ctx context.Context, evType string, ip string, iface string, protocol string, port uint16, ts int64) (*rule.Rule, bool) {
+	if bc.c.ruleEngine == nil {
+		return nil, true
+	}
+	r, ok := bc.c.ruleEngine.Check(ip, evType, iface, protocol, port, ts)
+	if !ok {
+		return nil, false
+	}
+	if r == nil {
+		return nil, true
+	}
+	logutil.GetLogger(ctx).Debug("rule matched", zap.String("ip", ip), zap.String("ev_type", evType), zap.String("iface", iface),
+		zap.String("rule", r.Name), zap.String("scope", r.Scope))
+	return r, true
+}
+
+func nameOfRule(r *rule.Rule) string {
+	if r == nil {
+		return ""
+	}
+	return r.Name
 }
 
+// scopeOfRule 规则指定的封禁范围, 为空时封禁全部流量
+func scopeOfRule(r *rule.Rule) string {
+	if r == nil {
+		return ""
+	}
+	return r.Scope
+}
+
+// scopeOf 根据名称查找封禁范围, 名称为空或者已经从配置中移除时按全局封禁处理
+func (bc *IPBlackCage) scopeOf(ctx context.Context, name string) *blocker.BanScope {
+	if len(name) == 0 {
+		return nil
+	}
+	scope, ok := bc.c.banScopes[name]
+	if !ok {
+		logutil.GetLogger(ctx).Warn("ban scope not found, fallback to global ban", zap.String("scope", name))
+		return nil
+	}
+	return scope
+}
+
+// Stop 依次停止用户名单监听及全部事件来源, 等待事件循环处理完在途事件并将缓冲数据落库, 最后清理拦截规则(持久模式下保留)
+// ctx未设置超时时, 使用默认超时; 超时后事件循环放弃剩余事件直接退出
 func (bc *IPBlackCage) Stop(ctx context.Context) error {
+	var err error
+	bc.stopOnce.Do(func() {
+		err = bc.doStop(ctx)
+	})
+	return err
+}
+
+func (bc *IPBlackCage) doStop(ctx context.Context) error {
 	logutil.GetLogger(ctx).Debug("start handle stop action")
-	close(bc.done)
-	<-bc.done //wait
-	if err := bc.c.filter.Destroy(ctx); err != nil {
-		logutil.GetLogger(ctx).Error("clean blocker rules failed", zap.Error(err))
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultStopTimeout)
+		defer cancel()
+	}
+	bc.closeUserListWatcher(ctx)
+	close(bc.done) //不再接收用户名单变化及管理接口的请求
+	bc.closeEventReaders(ctx)
+	var err error
+	if bc.started {
+		select {
+		case <-bc.loopExit:
+		case <-ctx.Done():
+			close(bc.forceExit)
+			<-bc.loopExit
+			err = fmt.Errorf("wait event loop drain failed, err:%w", ctx.Err())
+		}
+	}
+	if bc.c.persistent {
+		logutil.GetLogger(ctx).Info("persistent mode, keep blocker rules")
+	} else if derr := bc.c.filter.Destroy(context.WithoutCancel(ctx)); derr != nil { //即使等待超时也需要清理拦截规则
+		logutil.GetLogger(ctx).Error("clean blocker rules failed", zap.Error(derr))
 	}
 	logutil.GetLogger(ctx).Debug("handle stop action finish")
-	return nil
+	return err
 }
 
 func (bc *IPBlackCage) Start(ctx context.Context) error {
 	if err := bc.initCageChain(ctx); err != nil {
 		return err
 	}
-	ch, err := bc.c.obs.Open(ctx)
+	ch, err := bc.openEventReaders(ctx)
 	if err != nil {
 		return err
 	}
+	if err := bc.watchUserList(ctx); err != nil {
+		bc.closeEventReaders(ctx)
+		return err
+	}
+	bc.started = true
 	go bc.startHandleEvent(ctx, ch)
 	return nil
 }
 
-func (bc *IPBlackCage) startHandleEvent(ctx context.Context, ch <-chan event.IEventData) {
-	unBanTicker := time.NewTicker(1 * time.Minute)
-	defer unBanTicker.Stop()
+func (bc *IPBlackCage) watchUserList(ctx context.Context) error {
+	watchFn := func(black bool) userlist.OnChangeFunc {
+		return func(ctx context.Context, diff *userlist.Diff) {
+			select {
+			case bc.userList <- &userListChange{black: black, diff: diff}:
+			case <-bc.done:
+			}
+		}
+	}
+	if bc.c.userBlackList != nil {
+		if err := bc.c.userBlackList.Watch(ctx, watchFn(true)); err != nil {
+			return fmt.Errorf("watch user black list failed, err:%w", err)
+		}
+	}
+	if bc.c.userWhiteList != nil {
+		if err := bc.c.userWhiteList.Watch(ctx, watchFn(false)); err != nil {
+			return fmt.Errorf("watch user white list failed, err:%w", err)
+		}
+	}
+	return nil
+}
+
+func (bc *IPBlackCage) closeUserListWatcher(ctx context.Context) {
+	for _, w := range []userlist.IWatcher{bc.c.userBlackList, bc.c.userWhiteList} {
+		if w == nil {
+			continue
+		}
+		if err := w.Close(); err != nil {
+			logutil.GetLogger(ctx).Error("close user list watcher failed", zap.Error(err))
+		}
+	}
+}
+
+// applyUserListChange 将用户名单文件的变化增量同步到blocker中, 不影响其他来源的条目
+func (bc *IPBlackCage) applyUserListChange(ctx context.Context, chg *userListChange) {
+	if chg.black {
+		bc.applyUserBlackList(ctx, chg.diff)
+		return
+	}
+	bc.applyUserWhiteList(ctx, chg.diff)
+}
+
+func (bc *IPBlackCage) applyUserBlackList(ctx context.Context, diff *userlist.Diff) {
+	now := time.Now()
+	for _, ip := range diff.Added {
+		if err := bc.c.filter.BanIP(ctx, ip, nil, 0); err != nil {
+			logutil.GetLogger(ctx).Error("ban user black ip failed", zap.String("ip", ip), zap.Error(err))
+			continue
+		}
+		metrics.Bans.WithLabelValues(metrics.ReasonUserList, "").Inc()
+		flows := bc.flushFlows(ctx, ip, nil)
+		logutil.GetLogger(ctx).Info("ban user black ip succ", zap.String("ip", ip), zap.Uint("killed_flows", flows))
+	}
+	for _, ip := range diff.Removed {
+		//该ip同时被事件检测封禁且尚未过期时, 保留内核中的条目
+		if bc.isBanned(ip, now) {
+			continue
+		}
+		if err := bc.c.filter.UnBanIP(ctx, ip, nil); err != nil {
+			logutil.GetLogger(ctx).Error("unban user black ip failed", zap.String("ip", ip), zap.Error(err))
+			continue
+		}
+		metrics.Unbans.WithLabelValues(metrics.ReasonUserList).Inc()
+		logutil.GetLogger(ctx).Info("unban user black ip succ", zap.String("ip", ip))
+	}
+}
+
+func (bc *IPBlackCage) applyUserWhiteList(ctx context.Context, diff *userlist.Diff) {
+	for _, ip := range diff.Added {
+		if err := bc.c.filter.WhiteIP(ctx, ip); err != nil {
+			logutil.GetLogger(ctx).Error("add user white ip failed", zap.String("ip", ip), zap.Error(err))
+			continue
+		}
+		bc.addWhiteEntry(ctx, ip, whiteSourceUser)
+		logutil.GetLogger(ctx).Info("add user white ip succ", zap.String("ip", ip))
+	}
+	for _, ip := range diff.Removed {
+		bc.removeWhiteEntry(ctx, ip, whiteSourceUser) //索引按来源区分, 其他来源的同名条目依然有效
+		if bc.isLocalNetworkEntry(ip) {               //内网保护的条目不能被移除
+			continue
+		}
+		if _, ok := bc.tempWhite[ip]; ok { //仍处于临时白名单中, 等待其自然过期
+			continue
+		}
+		if err := bc.c.filter.UnWhiteIP(ctx, ip); err != nil {
+			logutil.GetLogger(ctx).Error("remove user white ip failed", zap.String("ip", ip), zap.Error(err))
+			continue
+		}
+		logutil.GetLogger(ctx).Info("remove user white ip succ", zap.String("ip", ip))
+	}
+}
+
+func (bc *IPBlackCage) startHandleEvent(ctx context.Context, ch <-chan *sourceEvent) {
+	defer close(bc.loopExit)
+	visitTicker := time.NewTicker(defaultVisitFlushInterval)
+	defer visitTicker.Stop()
+	reconcileTicker := time.NewTicker(defaultReconcileInterval)
+	defer reconcileTicker.Stop()
+	tempWhiteTicker := time.NewTicker(defaultTempWhiteCheckInterval)
+	defer tempWhiteTicker.Stop()
+	statsTicker := time.NewTicker(defaultStatsInterval)
+	defer statsTicker.Stop()
+	bc.updateSetStats(ctx)
+	driftTicker := time.NewTicker(defaultDriftCheckInterval)
+	defer driftTicker.Stop()
 	for {
 		select {
-		case ev := <-ch:
+		case ev, ok := <-ch:
+			if !ok { //全部事件来源已关闭且在途事件已处理完
+				bc.flushVisits(ctx)
+				bc.flushHistory(ctx)
+				logutil.GetLogger(ctx).Debug("event loop exit")
+				return
+			}
 			if err := bc.handleOneEvent(ctx, ev); err != nil {
+				metrics.EventsHandled.WithLabelValues(ev.source, ev.EventType(), metrics.ResultFail).Inc()
 				logutil.GetLogger(ctx).Error("handle event failed", zap.Error(err), zap.String("ev_type", ev.EventType()), zap.Int64("ts", ev.Timestamp()))
 				continue
 			}
-		case <-unBanTicker.C:
-			if err := bc.unBanExpire(ctx); err != nil {
-				logutil.GetLogger(ctx).Error("do unban expire failed", zap.Error(err))
+			metrics.EventsHandled.WithLabelValues(ev.source, ev.EventType(), metrics.ResultSucc).Inc()
+		case chg := <-bc.userList:
+			bc.applyUserListChange(ctx, chg)
+		case act := <-bc.actions:
+			act.rs <- act.fn()
+		case <-tempWhiteTicker.C:
+			bc.expireTempWhite(ctx)
+		case <-statsTicker.C:
+			bc.updateSetStats(ctx)
+		case <-visitTicker.C:
+			bc.flushVisits(ctx)
+			bc.flushHistory(ctx)
+		case <-driftTicker.C:
+			if err := bc.repairFirewall(ctx); err != nil {
+				logutil.GetLogger(ctx).Error("repair firewall failed", zap.Error(err))
+				continue
+			}
+		case <-reconcileTicker.C:
+			bc.cleanHistory(ctx)
+			if err := bc.reconcileExpire(ctx); err != nil {
+				logutil.GetLogger(ctx).Error("do reconcile expire failed", zap.Error(err))
 				continue
 			}
-		case <-bc.done:
-			logutil.GetLogger(ctx).Debug("event loop exit")
+		case <-bc.forceExit:
+			bc.flushVisits(ctx)
+			bc.flushHistory(ctx)
+			logutil.GetLogger(ctx).Warn("event loop force exit")
 			return
 		}
 	}
 }
 
-func (bc *IPBlackCage) unBanExpire(ctx context.Context) error {
-	delims := uint64(time.Now().Add(-1 * bc.c.banTime).UnixMilli())
-	ips, err := bc.c.ipDao.ListBlackIP(ctx, &model.ListBlackIPCondition{
-		MtimeBetween: []uint64{0, delims},
-	}, 0, 100)
+// reconcileExpire 对账流程, 扫描全部黑名单记录, 将已过期的记录从DB中移除, 并为封禁时长超出内核上限的条目续期
+// 内核中的条目大部分已经由集合的timeout自动清除, 这里的UnBanIP主要用于兜底
+func (bc *IPBlackCage) reconcileExpire(ctx context.Context) error {
+	now := time.Now()
+	bc.pruneSubnetHits(now)
+	ips := make([]*model.BlackCageTab, 0, 128)
+	refreshes := make([]*model.BlackCageTab, 0, 16)
+	_, err := bc.c.ipDao.ScanBlackIP(ctx, 200, func(ctx context.Context, items []*model.BlackCageTab) error {
+		for _, item := range items {
+			if !bc.isExpired(item, now) {
+				if bc.needRefresh(item.IP, now) {
+					refreshes = append(refreshes, item)
+				}
+				continue
+			}
+			ips = append(ips, item)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
+	bc.refreshKernelTimeout(ctx, refreshes, now)
 	for _, ip := range ips {
 		logger := logutil.GetLogger(ctx).With(zap.String("ip", ip.IP),
 			zap.Int64("scan_count", ip.Counter),
 			zap.Int64("last_visit", int64(ip.MTime)))
-		if err := bc.c.filter.UnBanIP(ctx, ip.IP); err != nil {
+		if err := bc.c.filter.UnBanIP(ctx, ip.IP, bc.scopeOf(ctx, ip.Scope)); err != nil {
 			logger.Error("unban ip failed", zap.Error(err))
 			continue
 		}
@@ -190,49 +534,306 @@ func (bc *IPBlackCage) unBanExpire(ctx context.Context) error {
 			logger.Error("remove black ip from db failed", zap.Error(err))
 			continue
 		}
+		bc.unmarkBanned(ip.IP)
+		metrics.Unbans.WithLabelValues(metrics.ReasonExpired).Inc()
 		logger.Info("unban ip succ")
 	}
 	return nil
 }
 
+// trackKernelTimeout 记录内核条目的续期时间, 封禁时长超出内核上限时条目会先于DB记录过期
+// 续期时间预留两个对账周期, 保证条目在超时前被重新写入
+func (bc *IPBlackCage) trackKernelTimeout(ip string, remain time.Duration, now time.Time) {
+	if remain <= blocker.MaxTimeout {
+		delete(bc.refreshAt, ip)
+		return
+	}
+	bc.refreshAt[ip] = uint64(now.Add(blocker.MaxTimeout - 2*defaultReconcileInterval).UnixMilli())
+}
+
+func (bc *IPBlackCage) needRefresh(ip string, now time.Time) bool {
+	at, ok := bc.refreshAt[ip]
+	return ok && at <= uint64(now.UnixMilli())
+}
+
+// refreshKernelTimeout 按剩余时长重新写入内核条目
+func (bc *IPBlackCage) refreshKernelTimeout(ctx context.Context, items []*model.BlackCageTab, now time.Time) {
+	for _, item := range items {
+		remain := bc.remainBanTime(item, now)
+		if err := bc.c.filter.BanIP(ctx, item.IP, bc.scopeOf(ctx, item.Scope), remain); err != nil {
+			logutil.GetLogger(ctx).Error("refresh ip timeout failed", zap.String("ip", item.IP), zap.Error(err))
+			continue
+		}
+		bc.trackKernelTimeout(item.IP, remain, now)
+		logutil.GetLogger(ctx).Debug("refresh ip timeout succ", zap.String("ip", item.IP), zap.Duration("remain", remain))
+	}
+}
+
 func (bc *IPBlackCage) handleOneEvent(ctx context.Context, ev event.IEventData) error {
-	evn := ev.EventType()
-	ipdata := ev.Data().(*ipevent.IPEventData)
-	ts := ev.Timestamp()
+	var h *model.EventHistoryTab
+	var err error
+	switch data := ev.Data().(type) {
+	case *ipevent.IPEventData:
+		h = &model.EventHistoryTab{TS: uint64(ev.Timestamp()), EventType: ev.EventType(), Protocol: data.Protocol,
+			SrcIP: data.SrcIP, SrcPort: uint64(data.SrcPort), DstIP: data.DstIP, DstPort: uint64(data.DstPort), Iface: data.Iface}
+		err = bc.handlePortScanEvent(ctx, ev.EventType(), data, ev.Timestamp(), h)
+	case *logevent.LogEventData:
+		h = &model.EventHistoryTab{TS: uint64(ev.Timestamp()), EventType: ev.EventType(), SrcIP: data.IP, Rule: data.Rule,
+			Detail: truncateDetail(data.File + ":" + data.Line)}
+		err = bc.handleLogMatchEvent(ctx, ev.EventType(), data, ev.Timestamp(), h)
+	default:
+		return fmt.Errorf("unsupported event data, type:%s", ev.EventType())
+	}
+	if err != nil {
+		h.Action = model.HistoryActionFail
+	}
+	bc.recordHistory(ctx, h)
+	return err
+}
+
+// checkEventSource 检查事件来源是否命中白名单或者已处于封禁中, 返回false时事件无需继续处理
+func (bc *IPBlackCage) checkEventSource(ctx context.Context, evn string, ip string, h *model.EventHistoryTab) bool {
+	if hit, ok := bc.whiteHitOf(ip); ok {
+		logutil.GetLogger(ctx).Debug("ignore event from white ip", zap.String("ip", ip), zap.String("ev_type", evn),
+			zap.String("white_entry", hit.Entry), zap.Strings("white_sources", hit.Sources))
+		h.Action = model.HistoryActionWhite
+		return false
+	}
+	//已封禁ip的重复命中(pcap先于netfilter看到数据包)只在内存中计数, 不访问DB
+	if key, ok := bc.bannedKeyOf(ip, time.Now()); !bc.c.viewMode && ok {
+		bc.recordVisit(ctx, key, time.Now())
+		h.Action = model.HistoryActionHit
+		return false
+	}
+	return true
+}
+
+func (bc *IPBlackCage) handleLogMatchEvent(ctx context.Context, evn string, data *logevent.LogEventData, ts int64, h *model.EventHistoryTab) error {
+	h.Action = model.HistoryActionPass
+	if !bc.checkEventSource(ctx, evn, data.IP, h) {
+		return nil
+	}
+	r, ok := bc.checkShouldBanIPByRules(ctx, evn, data.IP, "", "", 0, ts)
+	if !ok {
+		return nil
+	}
+	reason := &model.BanReason{Reason: model.BanReasonEvent, EventType: evn, Rule: data.Rule}
+	if r != nil { //优先记录规则引擎中触发封禁的规则
+		reason.Rule = r.Name
+	}
+	h.Rule = reason.Rule
+	logger := logutil.GetLogger(ctx).With(zap.String("ip", data.IP), zap.String("rule", data.Rule), zap.String("file", data.File))
+	if bc.c.viewMode {
+		logger.Debug("view mode open, skip next", zap.String("line", data.Line))
+		return nil
+	}
+	isNew, err := bc.banIP(ctx, data.IP, reason, scopeOfRule(r), model.BanDurationAuto)
+	if err != nil {
+		logger.Error("add ip to black list failed", zap.Error(err))
+		return err
+	}
+	if !isNew {
+		h.Action = model.HistoryActionHit
+		return nil
+	}
+	h.Action = model.HistoryActionBan
+	metrics.Bans.WithLabelValues(metrics.ReasonEvent, "").Inc()
+	logger.Info("add ip to black list succ", zap.Int64("ts", ts))
+	return nil
+}
 
-	if !bc.checkShouldBanIPByRules(ctx, ipdata) {
+func (bc *IPBlackCage) handlePortScanEvent(ctx context.Context, evn string, ipdata *ipevent.IPEventData, ts int64, h *model.EventHistoryTab) error {
+	h.Action = model.HistoryActionPass
+	if !bc.checkEventSource(ctx, evn, ipdata.SrcIP, h) {
+		return nil
+	}
+	r, ok := bc.checkShouldBanIPByRules(ctx, evn, ipdata.SrcIP, ipdata.Iface, ipdata.Protocol, ipdata.DstPort, ts)
+	if !ok {
 		return nil
 	}
-	logger := logutil.GetLogger(ctx).With(zap.String("src", fmt.Sprintf("%s:%d", ipdata.SrcIP, ipdata.SrcPort)), zap.String("dst", fmt.Sprintf("%s:%d", ipdata.DstIP, ipdata.DstPort)))
+	h.Rule = nameOfRule(r)
+	logger := logutil.GetLogger(ctx).With(zap.String("src", net.JoinHostPort(ipdata.SrcIP, strconv.Itoa(int(ipdata.SrcPort)))), zap.String("dst", net.JoinHostPort(ipdata.DstIP, strconv.Itoa(int(ipdata.DstPort)))), zap.String("iface", ipdata.Iface))
 	if bc.c.viewMode {
 		logger.Debug("view mode open, skip next")
 		return nil
 	}
 
-	isNew, err := bc.addToBlackList(ctx, evn, ipdata, ts)
+	isNew, err := bc.addToBlackList(ctx, evn, ipdata, r, ts)
 	if err != nil {
 		logger.Error("add ip to black list failed", zap.Error(err))
 		return err
 	}
 	if !isNew {
+		h.Action = model.HistoryActionHit
 		return nil
 	}
+	h.Action = model.HistoryActionBan
 	logger.Info("add ip to black list succ", zap.Int64("ts", ts))
 	return nil
 }
 
-func (bc *IPBlackCage) addToBlackList(ctx context.Context, ev string, ipdata *ipevent.IPEventData, _ int64) (bool, error) {
-	_, ok, err := bc.c.ipDao.GetBlackIP(ctx, ipdata.SrcIP)
+func (bc *IPBlackCage) addToBlackList(ctx context.Context, ev string, ipdata *ipevent.IPEventData, r *rule.Rule, _ int64) (bool, error) {
+	reason := &model.BanReason{
+		Reason:    model.BanReasonEvent,
+		EventType: ev,
+		Rule:      nameOfRule(r),
+		Protocol:  ipdata.Protocol,
+		DstPort:   ipdata.DstPort,
+		Iface:     ipdata.Iface,
+	}
+	isNew, err := bc.banIP(ctx, ipdata.SrcIP, reason, scopeOfRule(r), model.BanDurationAuto)
 	if err != nil {
 		return false, err
 	}
-	if ok { // 已经存在了, 那么更新计数
-		_ = bc.c.ipDao.IncrBlackIPVisit(ctx, ipdata.SrcIP)
+	if isNew {
+		metrics.Bans.WithLabelValues(metrics.ReasonEvent, strconv.Itoa(int(ipdata.DstPort))).Inc()
+	}
+	return isNew, nil
+}
+
+// repairFirewall 巡检防火墙规则, 集合丢失时从DB及用户名单中整体重建
+func (bc *IPBlackCage) repairFirewall(ctx context.Context) error {
+	drift, err := bc.c.filter.Repair(ctx)
+	if err != nil {
+		return err
+	}
+	if len(drift.Items) == 0 {
+		return nil
+	}
+	logutil.GetLogger(ctx).Warn("firewall drift repaired", zap.Strings("items", drift.Items), zap.Bool("need_rebuild", drift.NeedRebuild))
+	if !drift.NeedRebuild {
+		return nil
+	}
+	if err := bc.initCageChain(ctx); err != nil {
+		return fmt.Errorf("rebuild cage chain failed, err:%w", err)
+	}
+	for ip := range bc.tempWhite { //临时白名单不在DB中, 需要单独补回
+		if err := bc.c.filter.WhiteIP(ctx, ip); err != nil {
+			logutil.GetLogger(ctx).Error("restore temp white ip failed", zap.String("ip", ip), zap.Error(err))
+		}
+	}
+	logutil.GetLogger(ctx).Info("rebuild cage chain succ")
+	return nil
+}
+
+// updateSetStats 更新内核集合元素数的监控
+func (bc *IPBlackCage) updateSetStats(ctx context.Context) {
+	stats, err := bc.c.filter.Stats(ctx)
+	if err != nil {
+		logutil.GetLogger(ctx).Error("read blocker stats failed", zap.Error(err))
+		return
+	}
+	for _, st := range stats {
+		metrics.SetEntries.WithLabelValues(st.Name).Set(float64(st.Entries))
+	}
+	bc.usage = blocker.NewSetUsage(stats)
+	bc.checkCapacityUsage(ctx)
+}
+
+// banIP 封禁ip的统一入口, 事件检测与手动封禁都经过这里, 保证DB与blocker中的数据一致, reason为结构化的封禁原因
+// dur为model.BanDurationAuto时按历史被封禁次数选择封禁时长, scope为空时封禁全部流量
+// 同一个ip同时只保留一条封禁记录, 已处于封禁中的ip不会因为其他范围的规则再次封禁
+func (bc *IPBlackCage) banIP(ctx context.Context, ip string, reason *model.BanReason, scope string, dur time.Duration) (bool, error) {
+	now := time.Now()
+	if hit, ok := bc.whiteHitOf(ip); ok { //白名单中的ip不写入DB及blocker
+		return false, fmt.Errorf("%w, entry:%s, sources:%v", errIPWhitelisted, hit.Entry, hit.Sources)
+	}
+	if key, ok := bc.bannedKeyOf(ip, now); ok { // 已经存在了(或者所在网段已被合并封禁), 那么更新计数
+		bc.recordVisit(ctx, key, now)
 		return false, nil
 	}
-	if err := bc.c.filter.BanIP(ctx, ipdata.SrcIP); err != nil {
+	item, ok, err := bc.c.ipDao.GetBlackIP(ctx, ip)
+	if err != nil {
+		return false, err
+	}
+	if ok && !bc.isExpired(item, now) { //内存索引之外的记录(例如在运行期间被外部写入), 补齐索引
+		bc.markBanned(ip, bc.expireAtOf(item))
+		bc.recordVisit(ctx, ip, now)
+		return false, nil
+	}
+	if ok { //记录已过期但尚未被对账流程清理, 视为新的一次违规
+		if _, err := bc.c.ipDao.DelBlackIP(ctx, ip); err != nil {
+			return false, err
+		}
+		bc.unmarkBanned(ip)
+	}
+	var offenses int64
+	offense, ok, err := bc.c.ipDao.GetOffense(ctx, ip)
+	if err != nil {
 		return false, err
 	}
-	bc.c.ipDao.AddBlackIP(ctx, ipdata.SrcIP, fmt.Sprintf("detect_by_event:%s|%d", ev, ipdata.DstPort))
+	if ok {
+		offenses = offense.BanCount
+	}
+	if dur == model.BanDurationAuto {
+		dur = bc.banDuration(offenses)
+	}
+	expireAt := model.ExpireAtPermanent
+	if dur > 0 {
+		expireAt = uint64(now.Add(dur).UnixMilli())
+	}
+	banScope := bc.scopeOf(ctx, scope)
+	entries, err := bc.ensureCapacity(ctx, ip, banScope, now)
+	if err != nil {
+		return false, err
+	}
+	if err := bc.c.filter.BanIP(ctx, ip, banScope, dur); err != nil {
+		return false, err
+	}
+	if bc.usage != nil {
+		bc.usage.Add(entries, 1)
+	}
+	tab := &model.BlackCageTab{
+		IP:        ip,
+		Remark:    reason.Remark,
+		ExpireAt:  expireAt,
+		Scope:     scope,
+		Reason:    reason.Reason,
+		EventType: reason.EventType,
+		Rule:      reason.Rule,
+		Protocol:  reason.Protocol,
+		DstPort:   uint64(reason.DstPort),
+		Iface:     reason.Iface,
+	}
+	if err := bc.c.ipDao.AddBlackIP(ctx, tab); err != nil {
+		return false, err
+	}
+	bc.markBanned(ip, expireAt)
+	bc.trackKernelTimeout(ip, dur, now)
+	if err := bc.c.ipDao.IncrOffense(ctx, ip); err != nil {
+		return false, err
+	}
+	flows := bc.flushFlows(ctx, ip, banScope)
+	logutil.GetLogger(ctx).Info("ban ip with escalation", zap.String("ip", ip), zap.String("scope", scope),
+		zap.Int64("offenses", offenses), zap.Duration("ban_time", dur), zap.Uint("killed_flows", flows))
+	if len(scope) == 0 {
+		bc.trackSubnetBan(ctx, ip, now)
+	}
 	return true, nil
 }
+
+// flushFlows 清理被封禁ip已建立的连接, 否则ESTABLISHED的放行规则会让这些连接继续存活
+// 清理失败不影响封禁结果, 仅记录日志
+func (bc *IPBlackCage) flushFlows(ctx context.Context, ip string, scope *blocker.BanScope) uint {
+	if bc.c.flusher == nil {
+		return 0
+	}
+	var matches []*conntrack.Match
+	if scope != nil {
+		for _, proto := range scope.Protocols() {
+			if len(scope.Ports) == 0 {
+				matches = append(matches, &conntrack.Match{Protocol: proto})
+				continue
+			}
+			for _, port := range scope.Ports {
+				matches = append(matches, &conntrack.Match{Protocol: proto, Port: port})
+			}
+		}
+	}
+	cnt, err := bc.c.flusher.Flush(ctx, ip, matches...)
+	if err != nil {
+		logutil.GetLogger(ctx).Error("flush conntrack of ip failed", zap.String("ip", ip), zap.Error(err))
+		return 0
+	}
+	return cnt
+}
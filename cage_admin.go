@@ -0,0 +1,259 @@
+package ipblackcage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ip-blackcage/blocker"
+	"ip-blackcage/metrics"
+	"ip-blackcage/model"
+	"ip-blackcage/utils"
+	"net"
+	"time"
+
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+var (
+	errCageStopped = errors.New("cage stopped")
+)
+
+// cageAction 外部发起的操作, 统一投递到事件循环中执行, 避免与事件处理并发修改blocker/DB
+type cageAction struct {
+	fn func() error
+	rs chan error
+}
+
+// runInLoop 将fn投递到事件循环中执行并等待结果, ctx仅用于控制等待
+// fn一旦投递就可能在调用方放弃等待后才执行, 因此fn内部需要使用context.WithoutCancel派生的ctx, 避免blocker与DB只完成一半
+func (bc *IPBlackCage) runInLoop(ctx context.Context, fn func() error) error {
+	act := &cageAction{fn: fn, rs: make(chan error, 1)}
+	select {
+	case bc.actions <- act:
+	case <-bc.done:
+		return errCageStopped
+	case <-bc.loopExit:
+		return errCageStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-act.rs:
+		return err
+	case <-bc.loopExit:
+		return errCageStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ListBlackIP 按ip前缀分页查询DB中的黑名单记录
+func (bc *IPBlackCage) ListBlackIP(ctx context.Context, ipPrefix string, offset, limit int64) ([]*model.BlackCageTab, error) {
+	return bc.c.ipDao.ListBlackIP(ctx, &model.ListBlackIPCondition{IPPrefix: ipPrefix}, offset, limit)
+}
+
+// ListEventHistory 按来源ip分页查询事件历史, ip为空时查询全部, 按时间倒序返回
+func (bc *IPBlackCage) ListEventHistory(ctx context.Context, ip string, offset, limit int64) ([]*model.EventHistoryTab, error) {
+	return bc.c.ipDao.ListEventHistory(ctx, &model.ListEventHistoryCondition{SrcIP: ip}, offset, limit)
+}
+
+// ManualBanIP 手动封禁ip, 与事件检测走同一个封禁流程, dur为0表示永久封禁, model.BanDurationAuto表示按封禁阶梯计算
+func (bc *IPBlackCage) ManualBanIP(ctx context.Context, ip string, reason string, dur time.Duration) (bool, error) {
+	ip, err := utils.CanonicalIP(ip)
+	if err != nil {
+		return false, fmt.Errorf("%w, %w", model.ErrInvalidArgument, err)
+	}
+	ctx2 := context.WithoutCancel(ctx)
+	var isNew bool
+	err = bc.runInLoop(ctx, func() error {
+		var err error
+		isNew, err = bc.banIP(ctx2, ip, &model.BanReason{Reason: model.BanReasonManual, Remark: reason}, "", dur)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if isNew {
+		metrics.Bans.WithLabelValues(metrics.ReasonManual, "").Inc()
+	}
+	logutil.GetLogger(ctx).Info("manual ban ip finish", zap.String("ip", ip), zap.String("reason", reason),
+		zap.Duration("ban_time", dur), zap.Bool("is_new", isNew))
+	return isNew, nil
+}
+
+// ManualUnBanIP 手动解封ip或者网段, 同时移除DB记录, 用户黑名单文件中的ip需要通过修改文件移除
+// ip处于合并后的网段封禁中时返回errIPCoveredBySubnet, 错误信息中包含对应的网段
+func (bc *IPBlackCage) ManualUnBanIP(ctx context.Context, ip string) (bool, error) {
+	ip, err := utils.CanonicalIP(ip)
+	if err != nil {
+		return false, fmt.Errorf("%w, %w", model.ErrInvalidArgument, err)
+	}
+	if bc.c.userBlackList != nil && bc.c.userBlackList.Contains(ip) {
+		return false, fmt.Errorf("ip:%s is defined in user black list file, err:%w", ip, model.ErrConflict)
+	}
+	ctx2 := context.WithoutCancel(ctx)
+	var exist bool
+	err = bc.runInLoop(ctx, func() error {
+		item, ok, err := bc.c.ipDao.GetBlackIP(ctx2, ip)
+		if err != nil {
+			return fmt.Errorf("read black ip from db failed, err:%w", err)
+		}
+		//ip所在网段已被合并封禁时, 单独解封ip不会生效, 需要由调用方解封整个网段
+		if key, covered := bc.bannedKeyOf(ip, time.Now()); !ok && covered && key != ip {
+			return fmt.Errorf("%w, ip:%s, subnet:%s", errIPCoveredBySubnet, ip, key)
+		}
+		var scope *blocker.BanScope
+		if ok {
+			scope = bc.scopeOf(ctx2, item.Scope)
+		}
+		if err := bc.c.filter.UnBanIP(ctx2, ip, scope); err != nil {
+			return fmt.Errorf("unban ip failed, err:%w", err)
+		}
+		exist, err = bc.c.ipDao.DelBlackIP(ctx2, ip)
+		if err != nil {
+			return fmt.Errorf("remove black ip from db failed, err:%w", err)
+		}
+		bc.unmarkBanned(ip)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if exist {
+		metrics.Unbans.WithLabelValues(metrics.ReasonManual).Inc()
+	}
+	logutil.GetLogger(ctx).Info("manual unban ip finish", zap.String("ip", ip), zap.Bool("exist", exist))
+	return exist, nil
+}
+
+// TempWhiteIP 将ip临时加入白名单, 到期后自动移除, 临时白名单不做持久化
+func (bc *IPBlackCage) TempWhiteIP(ctx context.Context, ip string, dur time.Duration) error {
+	ip, err := utils.CanonicalIP(ip)
+	if err != nil {
+		return fmt.Errorf("%w, %w", model.ErrInvalidArgument, err)
+	}
+	if dur <= 0 {
+		return fmt.Errorf("%w, invalid temp white duration:%s", model.ErrInvalidArgument, dur)
+	}
+	ctx2 := context.WithoutCancel(ctx)
+	expireAt := uint64(time.Now().Add(dur).UnixMilli())
+	err = bc.runInLoop(ctx, func() error {
+		if err := bc.c.filter.WhiteIP(ctx2, ip); err != nil {
+			return fmt.Errorf("white ip failed, err:%w", err)
+		}
+		if expireAt > bc.tempWhite[ip] {
+			bc.tempWhite[ip] = expireAt
+		}
+		bc.addWhiteEntry(ctx2, ip, whiteSourceTemp)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logutil.GetLogger(ctx).Info("add temp white ip succ", zap.String("ip", ip), zap.Duration("duration", dur))
+	return nil
+}
+
+// expireTempWhite 移除已到期的临时白名单, 同时存在于用户白名单/内网保护中的条目不从blocker中移除
+func (bc *IPBlackCage) expireTempWhite(ctx context.Context) {
+	now := uint64(time.Now().UnixMilli())
+	for ip, expireAt := range bc.tempWhite {
+		if expireAt > now {
+			continue
+		}
+		delete(bc.tempWhite, ip)
+		bc.removeWhiteEntry(ctx, ip, whiteSourceTemp)
+		if bc.isLocalNetworkEntry(ip) || (bc.c.userWhiteList != nil && bc.c.userWhiteList.Contains(ip)) {
+			continue
+		}
+		if err := bc.c.filter.UnWhiteIP(ctx, ip); err != nil {
+			logutil.GetLogger(ctx).Error("remove temp white ip failed", zap.String("ip", ip), zap.Error(err))
+			continue
+		}
+		logutil.GetLogger(ctx).Info("temp white ip expired", zap.String("ip", ip))
+	}
+}
+
+// ExplainIP 汇总DB记录, 用户名单文件, 内网保护及临时白名单, 解释ip当前的拦截状态
+func (bc *IPBlackCage) ExplainIP(ctx context.Context, ip string) (*model.IPExplain, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("%w, invalid ip:%s", model.ErrInvalidArgument, ip)
+	}
+	ip = parsed.String()
+	rs := &model.IPExplain{IP: ip}
+	item, ok, err := bc.c.ipDao.GetBlackIP(ctx, ip)
+	if err != nil {
+		return nil, fmt.Errorf("read black ip from db failed, err:%w", err)
+	}
+	if ok {
+		rs.DBRecord = item
+		rs.DBActive = !bc.isExpired(item, time.Now())
+	}
+	if !rs.DBActive { //ip本身没有生效的记录时, 检查所在网段是否已被合并封禁
+		if err := bc.explainSubnet(ctx, rs); err != nil {
+			return nil, err
+		}
+	}
+	offense, ok, err := bc.c.ipDao.GetOffense(ctx, ip)
+	if err != nil {
+		return nil, fmt.Errorf("read offense from db failed, err:%w", err)
+	}
+	if ok {
+		rs.BanCount = offense.BanCount
+	}
+	if bc.c.userBlackList != nil {
+		rs.UserBlackList = bc.c.userBlackList.Match(ip)
+	}
+	if bc.c.userWhiteList != nil {
+		rs.UserWhiteList = bc.c.userWhiteList.Match(ip)
+	}
+	if !bc.c.disableLocalNetworkProtect {
+		lst, _ := bc.readLocalNetworkList()
+		for _, entry := range lst {
+			if ok, _ := utils.IPContains(entry, ip); ok {
+				rs.LocalNetwork = append(rs.LocalNetwork, entry)
+			}
+		}
+	}
+	err = bc.runInLoop(ctx, func() error {
+		for entry, expireAt := range bc.tempWhite {
+			if ok, _ := utils.IPContains(entry, ip); ok && expireAt > rs.TempWhiteExpireAt {
+				rs.TempWhiteExpireAt = expireAt
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rs.Whitelisted = len(rs.UserWhiteList) > 0 || len(rs.LocalNetwork) > 0 || rs.TempWhiteExpireAt > 0
+	rs.Blocked = !rs.Whitelisted && (rs.DBActive || len(rs.UserBlackList) > 0)
+	return rs, nil
+}
+
+// explainSubnet 补充覆盖ip的网段封禁记录
+func (bc *IPBlackCage) explainSubnet(ctx context.Context, rs *model.IPExplain) error {
+	var subnet string
+	err := bc.runInLoop(ctx, func() error {
+		if key, ok := bc.bannedKeyOf(rs.IP, time.Now()); ok && key != rs.IP {
+			subnet = key
+		}
+		return nil
+	})
+	if err != nil || len(subnet) == 0 {
+		return err
+	}
+	item, ok, err := bc.c.ipDao.GetBlackIP(ctx, subnet)
+	if err != nil {
+		return fmt.Errorf("read subnet from db failed, err:%w", err)
+	}
+	if !ok {
+		return nil
+	}
+	rs.CoveredBy = subnet
+	rs.DBRecord = item
+	rs.DBActive = !bc.isExpired(item, time.Now())
+	return nil
+}
@@ -0,0 +1,167 @@
+package ipblackcage
+
+import (
+	"context"
+	"fmt"
+	"ip-blackcage/blocker"
+	"ip-blackcage/metrics"
+	"ip-blackcage/model"
+	"time"
+
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+const (
+	// OverflowReject 容量已满时拒绝新的封禁
+	OverflowReject = "reject"
+	// OverflowEvict 容量已满时淘汰访问次数最少且最久未访问的非永久封禁记录
+	OverflowEvict = "evict"
+)
+
+const (
+	defaultCapacityWarnRatio = 0.9
+	defaultEvictBatch        = 16
+	defaultEvictRounds       = 4
+)
+
+var (
+	errCageFull = fmt.Errorf("cage is full, err:%w", model.ErrConflict)
+)
+
+func validateOverflowPolicy(policy string) error {
+	switch policy {
+	case OverflowReject, OverflowEvict:
+		return nil
+	default:
+		return fmt.Errorf("unsupported overflow policy:%s", policy)
+	}
+}
+
+// 以下方法仅在事件循环中调用, 因此不需要加锁
+// 容量分为两部分: DB中未过期的封禁数不超过cage_size, 以及每个内核集合的元素数不超过其容量
+// 带端口范围的封禁在集合中占用多个元素, 用户黑名单文件中的条目同样占用集合容量, 但不参与淘汰
+
+// ensureCapacity 封禁前检查容量, 已满时按策略淘汰旧记录或者拒绝本次封禁, 返回本次封禁在各集合中占用的元素数
+func (bc *IPBlackCage) ensureCapacity(ctx context.Context, ip string, scope *blocker.BanScope, now time.Time) (map[string]int, error) {
+	entries, err := bc.c.filter.EntriesOf(ip, scope)
+	if err != nil {
+		return nil, fmt.Errorf("read set entries of ip failed, err:%w", err)
+	}
+	for round := 0; round < defaultEvictRounds; round++ {
+		set, ok := bc.hasRoom(entries, now)
+		if ok {
+			return entries, nil
+		}
+		logger := logutil.GetLogger(ctx).With(zap.String("ip", ip), zap.String("full_set", set), zap.Int("banned", len(bc.banned)),
+			zap.Uint64("cage_size", bc.c.cageSize))
+		if bc.c.overflowPolicy != OverflowEvict {
+			metrics.CageOverflow.WithLabelValues(OverflowReject).Inc()
+			logger.Warn("cage is full, reject new ban")
+			return nil, errCageFull
+		}
+		cnt, err := bc.evictBlackIPs(ctx, bc.evictScopesOf(ctx, ip, set), defaultEvictBatch)
+		if err != nil {
+			return nil, fmt.Errorf("evict black ips failed, err:%w", err)
+		}
+		if cnt == 0 { //全部为永久封禁或者用户黑名单, 无可淘汰的记录
+			metrics.CageOverflow.WithLabelValues(OverflowReject).Inc()
+			logger.Warn("cage is full and no entry can be evicted, reject new ban")
+			return nil, errCageFull
+		}
+	}
+	metrics.CageOverflow.WithLabelValues(OverflowReject).Inc()
+	logutil.GetLogger(ctx).Warn("cage is still full after eviction, reject new ban", zap.String("ip", ip))
+	return nil, errCageFull
+}
+
+// hasRoom 检查是否还能写入entries, 空间不足时返回已满的集合, cage_size已满时集合名为空
+func (bc *IPBlackCage) hasRoom(entries map[string]int, now time.Time) (string, bool) {
+	if bc.c.cageSize > 0 && uint64(len(bc.banned)) >= bc.c.cageSize {
+		//索引中可能残留尚未被对账流程清理的过期记录, 先移除后再判断
+		for ip, expireAt := range bc.banned {
+			if expireAt <= uint64(now.UnixMilli()) {
+				delete(bc.banned, ip)
+			}
+		}
+		if uint64(len(bc.banned)) >= bc.c.cageSize {
+			return "", false
+		}
+	}
+	if bc.usage == nil {
+		return "", true
+	}
+	return bc.usage.Fits(entries)
+}
+
+// evictScopesOf 返回淘汰后能够释放集合set的封禁范围, set为空时(cage_size已满)不限制范围
+func (bc *IPBlackCage) evictScopesOf(ctx context.Context, ip string, set string) []string {
+	if len(set) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(bc.c.banScopes)+1)
+	names = append(names, "")
+	for name := range bc.c.banScopes {
+		names = append(names, name)
+	}
+	rs := make([]string, 0, len(names))
+	for _, name := range names {
+		entries, err := bc.c.filter.EntriesOf(ip, bc.scopeOf(ctx, name))
+		if err != nil || entries[set] == 0 {
+			continue
+		}
+		rs = append(rs, name)
+	}
+	return rs
+}
+
+// evictBlackIPs 淘汰访问次数最少且最久未访问的记录, 返回淘汰的数量
+func (bc *IPBlackCage) evictBlackIPs(ctx context.Context, scopes []string, limit int64) (int, error) {
+	bc.flushVisits(ctx) //先落库缓冲中的计数, 避免活跃ip被误淘汰
+	items, err := bc.c.ipDao.ListEvictCandidates(ctx, scopes, limit)
+	if err != nil {
+		return 0, err
+	}
+	cnt := 0
+	for _, item := range items {
+		logger := logutil.GetLogger(ctx).With(zap.String("ip", item.IP), zap.Int64("counter", item.Counter), zap.Uint64("mtime", item.MTime))
+		scope := bc.scopeOf(ctx, item.Scope)
+		if err := bc.c.filter.UnBanIP(ctx, item.IP, scope); err != nil {
+			logger.Error("unban evicted ip failed", zap.Error(err))
+			continue
+		}
+		if _, err := bc.c.ipDao.DelBlackIP(ctx, item.IP); err != nil {
+			logger.Error("remove evicted ip from db failed", zap.Error(err))
+			continue
+		}
+		bc.unmarkBanned(item.IP)
+		if entries, err := bc.c.filter.EntriesOf(item.IP, scope); err == nil && bc.usage != nil {
+			bc.usage.Add(entries, -1)
+		}
+		cnt++
+		metrics.CageOverflow.WithLabelValues(OverflowEvict).Inc()
+		metrics.Unbans.WithLabelValues(metrics.ReasonEvicted).Inc()
+		logger.Info("evict black ip succ")
+	}
+	return cnt, nil
+}
+
+// checkCapacityUsage 更新容量使用率(取cage_size与各集合中最高的使用率), 接近上限时输出告警
+func (bc *IPBlackCage) checkCapacityUsage(ctx context.Context) {
+	name, ratio := "", float64(0)
+	if bc.usage != nil {
+		name, ratio = bc.usage.MaxRatio()
+	}
+	if bc.c.cageSize > 0 {
+		if r := float64(len(bc.banned)) / float64(bc.c.cageSize); r >= ratio {
+			name, ratio = "", r
+		}
+	}
+	metrics.CageUsage.Set(ratio)
+	if ratio < defaultCapacityWarnRatio {
+		return
+	}
+	logutil.GetLogger(ctx).Warn("cage is approaching its capacity",
+		zap.Int("banned", len(bc.banned)), zap.Uint64("cage_size", bc.c.cageSize), zap.String("set", name),
+		zap.Float64("ratio", ratio), zap.String("overflow_policy", bc.c.overflowPolicy))
+}
@@ -0,0 +1,134 @@
+package ipblackcage
+
+import (
+	"context"
+	"ip-blackcage/model"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHistoryFlushSize = 1024
+	defaultMaxDetailLength  = 1024
+	defaultMaxMergedDetails = 5 //合并行保留的最近事件详情条数
+)
+
+// 以下方法仅在事件循环中调用, 因此不需要加锁
+// history 为待落库的事件历史, 与命中计数共用写缓冲的刷新周期
+
+func (bc *IPBlackCage) historyEnabled() bool {
+	return bc.c.historyKeep > 0 || bc.c.historyMaxRows > 0
+}
+
+func truncateDetail(detail string) string {
+	if len(detail) <= defaultMaxDetailLength {
+		return detail
+	}
+	return detail[:defaultMaxDetailLength]
+}
+
+// historyKey 相同来源在同一个写缓冲周期内的相同处理结果只记录一行, 避免已封禁来源的洪泛流量逐条写入
+type historyKey struct {
+	srcIP     string
+	eventType string
+	protocol  string
+	dstIP     string
+	dstPort   uint64
+	iface     string
+	rule      string
+	action    string
+}
+
+func historyKeyOf(h *model.EventHistoryTab) historyKey {
+	return historyKey{
+		srcIP:     h.SrcIP,
+		eventType: h.EventType,
+		protocol:  h.Protocol,
+		dstIP:     h.DstIP,
+		dstPort:   h.DstPort,
+		iface:     h.Iface,
+		rule:      h.Rule,
+		action:    h.Action,
+	}
+}
+
+// historyRow 缓冲中的一条合并记录, details保留最近的若干条事件详情(如日志行), 落库时按行拼接
+type historyRow struct {
+	tab     *model.EventHistoryTab
+	details []string
+}
+
+func (r *historyRow) addDetail(detail string) {
+	if len(detail) == 0 {
+		return
+	}
+	r.details = append(r.details, detail)
+	if len(r.details) > defaultMaxMergedDetails {
+		r.details = r.details[len(r.details)-defaultMaxMergedDetails:]
+	}
+}
+
+// recordHistory 记录一次事件的处理结果, 与缓冲中的相同事件合并计数, 缓冲区满时立即落库
+func (bc *IPBlackCage) recordHistory(ctx context.Context, h *model.EventHistoryTab) {
+	if !bc.historyEnabled() || h == nil {
+		return
+	}
+	key := historyKeyOf(h)
+	if v, ok := bc.history[key]; ok {
+		v.tab.Count++
+		v.addDetail(h.Detail)
+		return
+	}
+	h.Count = 1
+	row := &historyRow{tab: h}
+	row.addDetail(h.Detail)
+	bc.history[key] = row
+	if len(bc.history) >= defaultHistoryFlushSize {
+		bc.flushHistory(ctx)
+	}
+}
+
+func (bc *IPBlackCage) flushHistory(ctx context.Context) {
+	if len(bc.history) == 0 {
+		return
+	}
+	items := make([]*model.EventHistoryTab, 0, len(bc.history))
+	for _, row := range bc.history {
+		row.tab.Detail = strings.Join(row.details, "\n")
+		items = append(items, row.tab)
+	}
+	bc.history = make(map[historyKey]*historyRow, defaultHistoryFlushSize)
+	sort.Slice(items, func(i, j int) bool { //按事件时间写入, 保证id与时间的顺序一致
+		return items[i].TS < items[j].TS
+	})
+	if err := bc.c.ipDao.AddEventHistoryBatch(ctx, items); err != nil {
+		//历史仅用于排查, 失败时直接丢弃, 避免缓冲区无限增长
+		logutil.GetLogger(ctx).Error("flush event history failed", zap.Int("count", len(items)), zap.Error(err))
+		return
+	}
+	logutil.GetLogger(ctx).Debug("flush event history succ", zap.Int("count", len(items)))
+}
+
+// cleanHistory 按保留时长及最大条数清理历史记录
+func (bc *IPBlackCage) cleanHistory(ctx context.Context) {
+	if !bc.historyEnabled() {
+		return
+	}
+	var before uint64
+	if bc.c.historyKeep > 0 {
+		before = uint64(time.Now().Add(-bc.c.historyKeep).UnixMilli())
+	}
+	cnt, err := bc.c.ipDao.CleanEventHistory(ctx, before, bc.c.historyMaxRows)
+	if err != nil {
+		logutil.GetLogger(ctx).Error("clean event history failed", zap.Error(err))
+		return
+	}
+	if cnt == 0 {
+		return
+	}
+	logutil.GetLogger(ctx).Info("clean event history succ", zap.Int64("count", cnt))
+}
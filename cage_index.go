@@ -0,0 +1,79 @@
+package ipblackcage
+
+import (
+	"context"
+	"ip-blackcage/model"
+	"time"
+
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultVisitFlushInterval = 5 * time.Second
+	defaultVisitFlushSize     = 1024
+)
+
+// 以下方法仅在事件循环中调用, 因此不需要加锁
+// banned 为DB中未过期黑名单的内存索引, 已封禁ip的重复命中只在内存中累计计数, 由写缓冲合并后批量落库
+
+func (bc *IPBlackCage) isBanned(ip string, now time.Time) bool {
+	_, ok := bc.bannedKeyOf(ip, now)
+	return ok
+}
+
+// bannedKeyOf 返回ip当前生效的封禁记录, ip所在网段已被合并封禁时返回网段
+func (bc *IPBlackCage) bannedKeyOf(ip string, now time.Time) (string, bool) {
+	if expireAt, ok := bc.banned[ip]; ok && expireAt > uint64(now.UnixMilli()) {
+		return ip, true
+	}
+	subnet, ok := bc.subnetOf(ip)
+	if !ok {
+		return "", false
+	}
+	if expireAt, ok := bc.banned[subnet]; ok && expireAt > uint64(now.UnixMilli()) {
+		return subnet, true
+	}
+	return "", false
+}
+
+func (bc *IPBlackCage) markBanned(ip string, expireAt uint64) {
+	bc.banned[ip] = expireAt
+}
+
+func (bc *IPBlackCage) unmarkBanned(ip string) {
+	delete(bc.banned, ip)
+	delete(bc.visits, ip)
+	delete(bc.refreshAt, ip)
+}
+
+// recordVisit 记录一次命中, 缓冲区满时立即落库
+func (bc *IPBlackCage) recordVisit(ctx context.Context, ip string, now time.Time) {
+	v, ok := bc.visits[ip]
+	if !ok {
+		v = &model.BlackIPVisit{IP: ip}
+		bc.visits[ip] = v
+	}
+	v.Count++
+	v.MTime = uint64(now.UnixMilli())
+	if len(bc.visits) >= defaultVisitFlushSize {
+		bc.flushVisits(ctx)
+	}
+}
+
+func (bc *IPBlackCage) flushVisits(ctx context.Context) {
+	if len(bc.visits) == 0 {
+		return
+	}
+	visits := make([]*model.BlackIPVisit, 0, len(bc.visits))
+	for _, v := range bc.visits {
+		visits = append(visits, v)
+	}
+	bc.visits = make(map[string]*model.BlackIPVisit, defaultVisitFlushSize)
+	if err := bc.c.ipDao.IncrBlackIPVisitBatch(ctx, visits); err != nil {
+		//计数仅用于统计展示, 失败时直接丢弃, 避免缓冲区无限增长
+		logutil.GetLogger(ctx).Error("flush black ip visits failed", zap.Int("count", len(visits)), zap.Error(err))
+		return
+	}
+	logutil.GetLogger(ctx).Debug("flush black ip visits succ", zap.Int("count", len(visits)))
+}
@@ -0,0 +1,72 @@
+package ipblackcage
+
+import (
+	"context"
+	"fmt"
+	"ip-blackcage/event"
+	"sync"
+
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultEventQueueSize = 1024
+)
+
+// sourceEvent 附带来源名称的事件, 用于按来源统计
+type sourceEvent struct {
+	event.IEventData
+	source string
+}
+
+// openEventReaders 打开全部事件来源, 并将事件汇入同一个channel, 由事件循环串行处理
+// 任一来源打开失败时, 关闭已经打开的来源
+func (bc *IPBlackCage) openEventReaders(ctx context.Context) (<-chan *sourceEvent, error) {
+	chs := make([]<-chan event.IEventData, 0, len(bc.c.obs))
+	for idx, obs := range bc.c.obs {
+		ch, err := obs.Open(ctx)
+		if err != nil {
+			for _, opened := range bc.c.obs[:idx] {
+				if cerr := opened.Close(); cerr != nil {
+					logutil.GetLogger(ctx).Error("close event reader failed", zap.String("source", opened.Name()), zap.Error(cerr))
+				}
+			}
+			return nil, fmt.Errorf("open event reader:%s failed, err:%w", obs.Name(), err)
+		}
+		chs = append(chs, ch)
+	}
+	merged := make(chan *sourceEvent, defaultEventQueueSize)
+	wg := &sync.WaitGroup{}
+	for idx, ch := range chs {
+		wg.Add(1)
+		go func(source string, ch <-chan event.IEventData) {
+			defer wg.Done()
+			bc.forwardEvents(source, ch, merged)
+		}(bc.c.obs[idx].Name(), ch)
+	}
+	go func() { //全部来源关闭后再关闭汇总channel, 事件循环据此判断事件已排空
+		wg.Wait()
+		close(merged)
+	}()
+	return merged, nil
+}
+
+func (bc *IPBlackCage) forwardEvents(source string, src <-chan event.IEventData, dst chan<- *sourceEvent) {
+	for ev := range src {
+		select {
+		case dst <- &sourceEvent{IEventData: ev, source: source}:
+		case <-bc.forceExit:
+			return
+		}
+	}
+}
+
+// closeEventReaders 关闭全部事件来源, 来源在途的事件仍会交给事件循环处理
+func (bc *IPBlackCage) closeEventReaders(ctx context.Context) {
+	for _, obs := range bc.c.obs {
+		if err := obs.Close(); err != nil {
+			logutil.GetLogger(ctx).Error("close event reader failed", zap.String("source", obs.Name()), zap.Error(err))
+		}
+	}
+}
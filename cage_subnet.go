@@ -0,0 +1,197 @@
+package ipblackcage
+
+import (
+	"context"
+	"fmt"
+	"ip-blackcage/metrics"
+	"ip-blackcage/model"
+	"ip-blackcage/utils"
+	"strings"
+	"time"
+
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSubnetIPv4Prefix = 24
+	defaultSubnetIPv6Prefix = 64
+)
+
+var (
+	errIPCoveredBySubnet = fmt.Errorf("ip is covered by subnet ban, err:%w", model.ErrConflict)
+)
+
+// SubnetEscalation 同一网段内在Window内被封禁的不同ip数达到Threshold时, 合并为整个网段的封禁
+// 合并后的网段封禁时长取成员中最长的剩余时长, 成员的记录及集合条目会被移除
+type SubnetEscalation struct {
+	Threshold  int
+	Window     time.Duration
+	IPv4Prefix int //为0时使用24
+	IPv6Prefix int //为0时使用64
+}
+
+func (s *SubnetEscalation) validate() error {
+	if s.Threshold < 2 {
+		return fmt.Errorf("subnet escalation threshold should be at least 2, get:%d", s.Threshold)
+	}
+	if s.Window <= 0 {
+		return fmt.Errorf("subnet escalation window should be positive")
+	}
+	if s.IPv4Prefix == 0 {
+		s.IPv4Prefix = defaultSubnetIPv4Prefix
+	}
+	if s.IPv6Prefix == 0 {
+		s.IPv6Prefix = defaultSubnetIPv6Prefix
+	}
+	if s.IPv4Prefix < 8 || s.IPv4Prefix >= 32 {
+		return fmt.Errorf("invalid ipv4 prefix:%d", s.IPv4Prefix)
+	}
+	if s.IPv6Prefix < 16 || s.IPv6Prefix >= 128 {
+		return fmt.Errorf("invalid ipv6 prefix:%d", s.IPv6Prefix)
+	}
+	return nil
+}
+
+// 以下方法仅在事件循环中调用, 因此不需要加锁
+// subnetHits 记录各网段内最近被封禁的ip及其封禁时间(毫秒)
+
+// subnetOf 返回ip在合并策略下所属的网段, 未开启合并或者本身为cidr时返回false
+func (bc *IPBlackCage) subnetOf(ip string) (string, bool) {
+	if bc.c.subnet == nil || strings.Contains(ip, "/") {
+		return "", false
+	}
+	isV4, err := utils.IsIPv4(ip)
+	if err != nil {
+		return "", false
+	}
+	ones := bc.c.subnet.IPv6Prefix
+	if isV4 {
+		ones = bc.c.subnet.IPv4Prefix
+	}
+	subnet, err := utils.IPPrefixOf(ip, ones)
+	if err != nil {
+		return "", false
+	}
+	return subnet, true
+}
+
+func (bc *IPBlackCage) addSubnetHit(ip string, ts int64) (string, bool) {
+	subnet, ok := bc.subnetOf(ip)
+	if !ok {
+		return "", false
+	}
+	hits, ok := bc.subnetHits[subnet]
+	if !ok {
+		hits = make(map[string]int64, bc.c.subnet.Threshold)
+		bc.subnetHits[subnet] = hits
+	}
+	hits[ip] = ts
+	return subnet, true
+}
+
+// pruneSubnetHits 移除窗口外的记录, 避免长期运行后内存持续增长
+func (bc *IPBlackCage) pruneSubnetHits(now time.Time) {
+	if bc.c.subnet == nil {
+		return
+	}
+	delims := now.Add(-bc.c.subnet.Window).UnixMilli()
+	for subnet, hits := range bc.subnetHits {
+		for ip, ts := range hits {
+			if ts <= delims {
+				delete(hits, ip)
+			}
+		}
+		if len(hits) == 0 {
+			delete(bc.subnetHits, subnet)
+		}
+	}
+}
+
+// trackSubnetBan 记录一次全局封禁, 同一网段内的封禁数达到阈值时合并为网段封禁
+func (bc *IPBlackCage) trackSubnetBan(ctx context.Context, ip string, now time.Time) {
+	subnet, ok := bc.addSubnetHit(ip, now.UnixMilli())
+	if !ok {
+		return
+	}
+	delims := now.Add(-bc.c.subnet.Window).UnixMilli()
+	hits := bc.subnetHits[subnet]
+	members := make([]string, 0, len(hits))
+	for member, ts := range hits {
+		if ts <= delims || !bc.isBanned(member, now) { //已过期或者已被手动解封的不再计入
+			delete(hits, member)
+			continue
+		}
+		members = append(members, member)
+	}
+	if len(members) < bc.c.subnet.Threshold {
+		return
+	}
+	delete(bc.subnetHits, subnet)
+	logger := logutil.GetLogger(ctx).With(zap.String("subnet", subnet), zap.Strings("members", members))
+	if hit, ok := bc.whiteHitOf(subnet); ok { //合并后的封禁不能覆盖任何白名单条目
+		logger.Warn("subnet overlaps white list, skip escalation", zap.String("white_entry", hit.Entry), zap.Strings("white_sources", hit.Sources))
+		return
+	}
+	if err := bc.escalateSubnet(ctx, subnet, members, now); err != nil {
+		logger.Error("escalate subnet ban failed", zap.Error(err))
+		return
+	}
+	metrics.Bans.WithLabelValues(metrics.ReasonSubnet, "").Inc()
+	logger.Info("escalate subnet ban succ")
+}
+
+// escalateSubnet 先移除成员的集合条目再写入网段, nftables的区间集合不允许元素之间存在重叠
+func (bc *IPBlackCage) escalateSubnet(ctx context.Context, subnet string, members []string, now time.Time) error {
+	maxExpireAt := uint64(0)
+	for _, member := range members {
+		if expireAt := bc.banned[member]; expireAt > maxExpireAt {
+			maxExpireAt = expireAt
+		}
+	}
+	var dur time.Duration //成员中存在永久封禁时, 网段同样永久封禁
+	if maxExpireAt != model.ExpireAtPermanent {
+		dur = time.UnixMilli(int64(maxExpireAt)).Sub(now)
+	}
+	for _, member := range members {
+		if err := bc.c.filter.UnBanIP(ctx, member, nil); err != nil {
+			bc.restoreSubnetMembers(ctx, members, now)
+			return fmt.Errorf("unban member:%s failed, err:%w", member, err)
+		}
+	}
+	reason := &model.BanReason{Reason: model.BanReasonSubnet, Remark: strings.Join(members, ",")}
+	if _, err := bc.banIP(ctx, subnet, reason, "", dur); err != nil {
+		//网段可能已写入blocker后才失败(如写DB失败), 需要先移除, 否则会留下未被跟踪的封禁, 且与恢复的成员重叠
+		if err := bc.c.filter.UnBanIP(ctx, subnet, nil); err != nil {
+			logutil.GetLogger(ctx).Error("remove subnet after escalation failure failed", zap.String("subnet", subnet), zap.Error(err))
+		}
+		bc.restoreSubnetMembers(ctx, members, now)
+		return fmt.Errorf("ban subnet failed, err:%w", err)
+	}
+	for _, member := range members {
+		if _, err := bc.c.ipDao.DelBlackIP(ctx, member); err != nil {
+			logutil.GetLogger(ctx).Error("remove subnet member from db failed", zap.String("ip", member), zap.Error(err))
+			continue
+		}
+		bc.unmarkBanned(member)
+	}
+	return nil
+}
+
+// restoreSubnetMembers 合并失败时按剩余时长重新写入成员, 合并期间已到期的成员不再写入, 由过期清理移除DB记录
+func (bc *IPBlackCage) restoreSubnetMembers(ctx context.Context, members []string, now time.Time) {
+	for _, member := range members {
+		var remain time.Duration
+		if expireAt := bc.banned[member]; expireAt != model.ExpireAtPermanent {
+			remain = time.UnixMilli(int64(expireAt)).Sub(now)
+			if remain <= 0 { //剩余时长为0会被当作永久封禁写入
+				continue
+			}
+		}
+		if err := bc.c.filter.BanIP(ctx, member, nil, remain); err != nil {
+			logutil.GetLogger(ctx).Error("restore subnet member failed", zap.String("ip", member), zap.Error(err))
+			continue
+		}
+		bc.trackKernelTimeout(member, remain, now)
+	}
+}
@@ -0,0 +1,67 @@
+package ipblackcage
+
+import (
+	"context"
+	"fmt"
+	"ip-blackcage/ipmatch"
+	"ip-blackcage/model"
+
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+// 白名单来源
+const (
+	whiteSourceUser  = "user_white_list"
+	whiteSourceLocal = "local_network"
+	whiteSourceExit  = "exit_ip"
+	whiteSourceTemp  = "temp_white"
+)
+
+var (
+	errIPWhitelisted = fmt.Errorf("ip is whitelisted, err:%w", model.ErrConflict)
+)
+
+// 以下方法仅在事件循环中调用
+// white 为进程内的白名单索引, 在封禁及写DB之前检查, 不依赖内核中的RETURN规则
+
+// rebuildWhiteMatcher 按当前的全部来源重建白名单索引
+func (bc *IPBlackCage) rebuildWhiteMatcher(ctx context.Context, userWhiteList []string, localNetworkList []string) {
+	m := ipmatch.NewMatcher()
+	sources := []struct {
+		name    string
+		entries []string
+	}{
+		{whiteSourceUser, userWhiteList},
+		{whiteSourceLocal, localNetworkList},
+		{whiteSourceExit, bc.c.exitIPs},
+	}
+	for _, src := range sources {
+		for _, entry := range src.entries {
+			if err := m.Add(entry, src.name); err != nil {
+				logutil.GetLogger(ctx).Error("add white entry failed", zap.String("source", src.name), zap.String("entry", entry), zap.Error(err))
+			}
+		}
+	}
+	for entry := range bc.tempWhite {
+		_ = m.Add(entry, whiteSourceTemp)
+	}
+	bc.white = m
+}
+
+func (bc *IPBlackCage) addWhiteEntry(ctx context.Context, entry string, source string) {
+	if err := bc.white.Add(entry, source); err != nil {
+		logutil.GetLogger(ctx).Error("add white entry failed", zap.String("source", source), zap.String("entry", entry), zap.Error(err))
+	}
+}
+
+func (bc *IPBlackCage) removeWhiteEntry(ctx context.Context, entry string, source string) {
+	if err := bc.white.Remove(entry, source); err != nil {
+		logutil.GetLogger(ctx).Error("remove white entry failed", zap.String("source", source), zap.String("entry", entry), zap.Error(err))
+	}
+}
+
+// whiteHitOf 返回与ip(或者cidr)存在交集的白名单条目
+func (bc *IPBlackCage) whiteHitOf(ip string) (*ipmatch.Hit, bool) {
+	return bc.white.Match(ip)
+}
@@ -3,19 +3,25 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	ipblackcage "ip-blackcage"
+	"ip-blackcage/admin"
 	"ip-blackcage/blocker"
 	"ip-blackcage/config"
+	"ip-blackcage/conntrack"
 	"ip-blackcage/dao"
 	"ip-blackcage/db"
+	"ip-blackcage/event"
 	"ip-blackcage/ipevent"
+	"ip-blackcage/logevent"
+	"ip-blackcage/metrics"
 	"ip-blackcage/route"
+	"ip-blackcage/rule"
+	"ip-blackcage/userlist"
 	"ip-blackcage/utils"
 	"log"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"strings"
 	"syscall"
 	"time"
 
@@ -27,6 +33,10 @@ import (
 
 var conf = flag.String("config", "./config.json", "config")
 
+const (
+	cmdCleanup = "cleanup"
+)
+
 func main() {
 	flag.Parse()
 	c, err := config.Parse(*conf)
@@ -34,14 +44,19 @@ func main() {
 		log.Fatalf("parse config failed, err:%v", err)
 	}
 	logkit := logger.Init(c.LogConfig.File, c.LogConfig.Level, int(c.LogConfig.FileCount), int(c.LogConfig.FileSize), int(c.LogConfig.KeepDays), c.LogConfig.Console)
-	logkit.Info("config init succ", zap.Any("config", c))
+	logkit.Info("config init succ", zap.Any("config", c.Masked()))
 	//初始化ip blocker
-	ipt, err := blocker.NewBlocker(
-		blocker.WithCageSize(c.CageSize),
-	)
+	ipt, err := createBlocker(c)
 	if err != nil {
 		logkit.Fatal("init blocker failed", zap.Error(err))
 	}
+	if cmd := flag.Arg(0); len(cmd) > 0 {
+		if cmd != cmdCleanup {
+			logkit.Fatal("unknown sub command", zap.String("cmd", cmd))
+		}
+		cleanup(context.Background(), ipt)
+		return
+	}
 	portlist, err := c.DecodePortList()
 	if err != nil {
 		logkit.Fatal("decode port list failed", zap.Error(err))
@@ -53,17 +68,23 @@ func main() {
 	if err := rebuildExitIPs(&c.NetConfig); err != nil {
 		logkit.Fatal("rebuild exit ips failed", zap.Error(err))
 	}
-	logkit.Info("use exit iface name", zap.String("name", c.NetConfig.Interface))
+	logkit.Info("use exit iface names", zap.Strings("names", c.NetConfig.Interfaces))
 	logkit.Info("use exit ips", zap.Strings("ips", c.NetConfig.ExitIPs))
 	//初始化ip事件读取器
 	evr, err := ipevent.NewIPEventReader(
 		ipevent.WithEnablePortVisit(portlist),
-		ipevent.WithExitIface(c.NetConfig.Interface),
+		ipevent.WithExitIfaces(c.NetConfig.Interfaces),
 		ipevent.WithExitIps(c.NetConfig.ExitIPs),
+		ipevent.WithSnapLen(c.NetConfig.SnapLen),
+		ipevent.WithPromisc(c.NetConfig.Promisc),
 	)
 	if err != nil {
 		logkit.Fatal("init event reader failed", zap.Error(err))
 	}
+	lev, err := createLogEventReader(c)
+	if err != nil {
+		logkit.Fatal("init log event reader failed", zap.Error(err))
+	}
 	//初始化db
 	if err := initDB(c.DBFile); err != nil {
 		logkit.Fatal("init db failed", zap.Error(err))
@@ -73,23 +94,45 @@ func main() {
 	if err != nil {
 		logkit.Fatal("init ip db dao failed", zap.Error(err))
 	}
-	ublist, err := resolveUserFile(c.UserIPBlackListDir, "blacklist-")
+	ublist, err := createUserListWatcher(c.UserIPBlackListDir, "blacklist-")
 	if err != nil {
 		logkit.Fatal("init user black list failed", zap.Error(err))
 	}
-	uwlist, err := resolveUserFile(c.UserIPWhiteListDir, "whitelist-")
+	uwlist, err := createUserListWatcher(c.UserIPWhiteListDir, "whitelist-")
 	if err != nil {
 		logkit.Fatal("init user white list failed", zap.Error(err))
 	}
+	scopes, err := createBanScopes(c)
+	if err != nil {
+		logkit.Fatal("init ban scopes failed", zap.Error(err))
+	}
+	ruleEngine, err := createRuleEngine(c)
+	if err != nil {
+		logkit.Fatal("init rule engine failed", zap.Error(err))
+	}
+	flusher, err := createConntrackFlusher(c)
+	if err != nil {
+		logkit.Fatal("init conntrack flusher failed", zap.Error(err))
+	}
 	cage, err := ipblackcage.New(
-		ipblackcage.WithEventReader(evr),
+		ipblackcage.WithEventReader(evr, lev),
 		ipblackcage.WithBlocker(ipt),
 		ipblackcage.WithIPDBDao(ipdao),
 		ipblackcage.WithUserIPBlackList(ublist),
 		ipblackcage.WithUserIPWhiteList(uwlist),
 		ipblackcage.WithViewMode(c.ViewMode),
 		ipblackcage.WithBanTime(time.Duration(c.BanTime)*time.Second),
+		ipblackcage.WithBanLadder(decodeBanLadder(c.BanLadder)),
 		ipblackcage.WithDisableLocalNetworkProtect(c.DisableLocalNetworkProtect),
+		ipblackcage.WithRuleEngine(ruleEngine),
+		ipblackcage.WithBanScopes(scopes...),
+		ipblackcage.WithPersistent(c.Persistent),
+		ipblackcage.WithConntrackFlusher(flusher),
+		ipblackcage.WithSubnetEscalation(decodeSubnetEscalation(&c.SubnetEscalation)),
+		ipblackcage.WithCageSize(c.CageSize),
+		ipblackcage.WithOverflowPolicy(c.OverflowPolicy),
+		ipblackcage.WithExitIPs(c.NetConfig.ExitIPs),
+		ipblackcage.WithEventHistory(time.Duration(c.EventHistory.KeepDays)*24*time.Hour, c.EventHistory.MaxRows),
 	)
 	if err != nil {
 		logkit.Fatal("init cage failed", zap.Error(err))
@@ -99,60 +142,267 @@ func main() {
 	if err := cage.Start(ctx); err != nil {
 		logkit.Fatal("run cage failed", zap.Error(err))
 	}
-	waitSignalAndExit(ctx, cage)
+	adminSvr, err := startAdminServer(ctx, c, cage)
+	if err != nil {
+		logkit.Fatal("start admin server failed", zap.Error(err))
+	}
+	metricSvr, err := startMetricServer(ctx, c)
+	if err != nil {
+		logkit.Fatal("start metric server failed", zap.Error(err))
+	}
+	waitSignalAndExit(ctx, cage, adminSvr, metricSvr, func(ctx context.Context) {
+		reloadPortList(ctx, evr)
+	})
 }
 
-func rebuildExitIfaceName(netc *config.NetConfig) error {
-	if len(netc.Interface) > 0 {
-		return nil
+// reloadPortList 收到SIGHUP时重新读取配置中的探测端口
+func reloadPortList(ctx context.Context, evr ipevent.IIPEventReader) {
+	c, err := config.Parse(*conf)
+	if err != nil {
+		logutil.GetLogger(ctx).Error("reload config failed", zap.Error(err))
+		return
 	}
-	iface, err := route.DetectExitInterface()
+	portlist, err := c.DecodePortList()
 	if err != nil {
-		return err
+		logutil.GetLogger(ctx).Error("decode port list failed", zap.Error(err))
+		return
 	}
-	netc.Interface = iface
-	return nil
+	if err := evr.UpdatePorts(portlist); err != nil {
+		logutil.GetLogger(ctx).Error("update port list failed", zap.Error(err))
+		return
+	}
+	logutil.GetLogger(ctx).Info("reload port list succ", zap.Int("port_count", len(portlist)))
 }
 
-func rebuildExitIPs(netc *config.NetConfig) error {
-	ips, err := route.ReadExitIP(netc.Interface)
+func startMetricServer(ctx context.Context, c *config.Config) (metrics.IServer, error) {
+	if len(c.MetricListen) == 0 {
+		return nil, nil
+	}
+	metrics.CageCapacity.Set(float64(c.CageSize))
+	svr, err := metrics.NewServer(c.MetricListen)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	netc.ExitIPs = utils.StringSliceDedup(append(ips, netc.ExitIPs...))
-	return nil
+	if err := svr.Start(ctx); err != nil {
+		return nil, err
+	}
+	return svr, nil
 }
 
-func resolveUserFile(dir string, prefix string) ([]string, error) {
-	if len(dir) == 0 {
+func startAdminServer(ctx context.Context, c *config.Config, cage *ipblackcage.IPBlackCage) (admin.IServer, error) {
+	if len(c.AdminConfig.Listen) == 0 {
 		return nil, nil
 	}
-	rs := make([]string, 0, 32)
-	entries, err := os.ReadDir(dir)
+	svr, err := admin.NewServer(
+		admin.WithListen(c.AdminConfig.Listen),
+		admin.WithToken(c.AdminConfig.Token),
+		admin.WithController(cage),
+	)
 	if err != nil {
 		return nil, err
 	}
-	for _, ent := range entries {
-		if ent.IsDir() {
+	if err := svr.Start(ctx); err != nil {
+		return nil, err
+	}
+	return svr, nil
+}
+
+func createBlocker(c *config.Config) (blocker.IBlocker, error) {
+	opts := []blocker.Option{
+		blocker.WithCageSize(c.CageSize),
+		blocker.WithIPSetDriver(c.IPSetDriver),
+		blocker.WithPersistent(c.Persistent),
+		blocker.WithBanAction(c.BanAction),
+		blocker.WithTarpitRate(c.TarpitRate),
+	}
+	switch c.BlockerBackend {
+	case blocker.BackendIPTables:
+		return blocker.NewBlocker(opts...)
+	case blocker.BackendNFTables:
+		return blocker.NewNftBlocker(opts...)
+	default:
+		return nil, fmt.Errorf("unsupported blocker backend:%s", c.BlockerBackend)
+	}
+}
+
+func decodeSubnetEscalation(sc *config.SubnetEscalationConfig) *ipblackcage.SubnetEscalation {
+	if sc.Threshold <= 0 {
+		return nil
+	}
+	return &ipblackcage.SubnetEscalation{
+		Threshold:  sc.Threshold,
+		Window:     time.Duration(sc.Window) * time.Second,
+		IPv4Prefix: sc.IPv4Prefix,
+		IPv6Prefix: sc.IPv6Prefix,
+	}
+}
+
+func createConntrackFlusher(c *config.Config) (conntrack.IFlusher, error) {
+	if !c.FlushConntrack {
+		return nil, nil
+	}
+	return conntrack.NewFlusher()
+}
+
+// cleanup 移除持久模式下保留的拦截规则及集合
+func cleanup(ctx context.Context, ipt blocker.IBlocker) {
+	if err := ipt.Destroy(ctx); err != nil {
+		logutil.GetLogger(ctx).Fatal("cleanup blocker rules failed", zap.Error(err))
+	}
+	logutil.GetLogger(ctx).Info("cleanup blocker rules succ")
+}
+
+// createBanScopes 解析封禁范围, 并检查规则引用的范围是否存在
+func createBanScopes(c *config.Config) ([]*blocker.BanScope, error) {
+	if len(c.BanScopes) > 0 && c.BlockerBackend != blocker.BackendIPTables {
+		return nil, fmt.Errorf("ban scopes not supported by blocker backend:%s", c.BlockerBackend)
+	}
+	names := make(map[string]struct{}, len(c.BanScopes))
+	rs := make([]*blocker.BanScope, 0, len(c.BanScopes))
+	for _, sc := range c.BanScopes {
+		ports, err := sc.DecodePortList()
+		if err != nil {
+			return nil, fmt.Errorf("decode port list of scope:%s failed, err:%w", sc.Name, err)
+		}
+		scope := &blocker.BanScope{Name: sc.Name, Protocol: sc.Protocol, Ports: ports}
+		if err := scope.Validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := names[sc.Name]; ok {
+			return nil, fmt.Errorf("duplicate scope:%s", sc.Name)
+		}
+		names[sc.Name] = struct{}{}
+		rs = append(rs, scope)
+	}
+	for _, rc := range c.Rules {
+		if len(rc.Scope) == 0 {
 			continue
 		}
-		name := filepath.Base(ent.Name())
-		if strings.HasPrefix(name, prefix) {
-			rs = append(rs, filepath.Join(dir, ent.Name()))
+		if _, ok := names[rc.Scope]; !ok {
+			return nil, fmt.Errorf("scope:%s of rule:%s not found", rc.Scope, rc.Name)
 		}
 	}
 	return rs, nil
 }
 
+func createRuleEngine(c *config.Config) (rule.IRuleEngine, error) {
+	rules := make([]*rule.Rule, 0, len(c.Rules))
+	for _, rc := range c.Rules {
+		ports, err := rc.DecodePortList()
+		if err != nil {
+			return nil, fmt.Errorf("decode port list of rule:%s failed, err:%w", rc.Name, err)
+		}
+		rules = append(rules, &rule.Rule{
+			Name:          rc.Name,
+			Protocol:      rc.Protocol,
+			Ports:         ports,
+			Threshold:     rc.Threshold,
+			Window:        time.Duration(rc.Window) * time.Second,
+			DistinctPorts: rc.DistinctPorts,
+			Interfaces:    rc.Interfaces,
+			EventTypes:    rc.EventTypes,
+			Scope:         rc.Scope,
+		})
+	}
+	return rule.NewEngine(rule.WithRule(rules...))
+}
+
+func createLogEventReader(c *config.Config) (event.IEventReader, error) {
+	if len(c.LogRules) == 0 {
+		return nil, nil
+	}
+	rules := make([]*logevent.Rule, 0, len(c.LogRules))
+	for _, lc := range c.LogRules {
+		rules = append(rules, &logevent.Rule{
+			Name:      lc.Name,
+			Preset:    lc.Preset,
+			Files:     lc.Files,
+			Patterns:  lc.Patterns,
+			Threshold: lc.Threshold,
+			Window:    time.Duration(lc.Window) * time.Second,
+		})
+	}
+	return logevent.NewLogEventReader(logevent.WithRule(rules...))
+}
+
+func decodeBanLadder(ladder []uint64) []time.Duration {
+	rs := make([]time.Duration, 0, len(ladder))
+	for _, sec := range ladder {
+		rs = append(rs, time.Duration(sec)*time.Second)
+	}
+	return rs
+}
+
+func rebuildExitIfaceName(netc *config.NetConfig) error {
+	ifaces := make([]string, 0, len(netc.Interfaces)+1)
+	if len(netc.Interface) > 0 {
+		ifaces = append(ifaces, netc.Interface)
+	}
+	for _, iface := range netc.Interfaces {
+		if iface != config.InterfaceAuto {
+			ifaces = append(ifaces, iface)
+			continue
+		}
+		autos, err := route.DetectExitInterfaces()
+		if err != nil {
+			return err
+		}
+		ifaces = append(ifaces, autos...)
+	}
+	if len(ifaces) == 0 { //未配置时使用默认路由所在的网卡
+		iface, err := route.DetectExitInterface()
+		if err != nil {
+			return err
+		}
+		ifaces = append(ifaces, iface)
+	}
+	netc.Interfaces = utils.StringSliceDedup(ifaces)
+	return nil
+}
+
+func rebuildExitIPs(netc *config.NetConfig) error {
+	ips := make([]string, 0, 4)
+	for _, iface := range netc.Interfaces {
+		items, err := route.ReadExitIP(iface)
+		if err != nil {
+			return fmt.Errorf("read exit ip of iface:%s failed, err:%w", iface, err)
+		}
+		ips = append(ips, items...)
+	}
+	netc.ExitIPs = utils.StringSliceDedup(append(ips, netc.ExitIPs...))
+	return nil
+}
+
+func createUserListWatcher(dir string, prefix string) (userlist.IWatcher, error) {
+	if len(dir) == 0 {
+		return nil, nil
+	}
+	return userlist.NewWatcher(dir, prefix)
+}
+
 func initDB(f string) error {
 	return db.InitDB(f)
 }
 
-func waitSignalAndExit(ctx context.Context, cage *ipblackcage.IPBlackCage) {
+func waitSignalAndExit(ctx context.Context, cage *ipblackcage.IPBlackCage, adminSvr admin.IServer, metricSvr metrics.IServer, onReload func(ctx context.Context)) {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	sig := <-sigs
+	for sig == syscall.SIGHUP {
+		onReload(ctx)
+		sig = <-sigs
+	}
 	logutil.GetLogger(ctx).Info("recv stop signal, stop ip cage", zap.Any("signal", sig.String()))
+	if adminSvr != nil {
+		if err := adminSvr.Stop(ctx); err != nil {
+			logutil.GetLogger(ctx).Error("stop admin server failed", zap.Error(err))
+		}
+	}
+	if metricSvr != nil {
+		if err := metricSvr.Stop(ctx); err != nil {
+			logutil.GetLogger(ctx).Error("stop metric server failed", zap.Error(err))
+		}
+	}
 	if err := cage.Stop(ctx); err != nil {
 		logutil.GetLogger(ctx).Error("stop cage failed", zap.Error(err))
 		os.Exit(1)
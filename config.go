@@ -2,22 +2,36 @@ package ipblackcage
 
 import (
 	"ip-blackcage/blocker"
+	"ip-blackcage/conntrack"
 	"ip-blackcage/dao"
 	"ip-blackcage/event"
+	"ip-blackcage/rule"
+	"ip-blackcage/userlist"
 	"time"
 )
 
 type config struct {
 	filter                     blocker.IBlocker
-	obs                        event.IEventReader
+	obs                        []event.IEventReader
 	ipDao                      dao.IIPDBDao
 	viewMode                   bool
 	banTime                    time.Duration
+	banLadder                  []time.Duration
 	disableLocalNetworkProtect bool
+	ruleEngine                 rule.IRuleEngine
+	persistent                 bool
+	banScopes                  map[string]*blocker.BanScope
+	flusher                    conntrack.IFlusher
+	subnet                     *SubnetEscalation
+	cageSize                   uint64
+	overflowPolicy             string
+	exitIPs                    []string
+	historyKeep                time.Duration
+	historyMaxRows             int64
 
 	//
-	userBlackList []string
-	userWhiteList []string
+	userBlackList userlist.IWatcher
+	userWhiteList userlist.IWatcher
 }
 
 type Option func(c *config)
@@ -28,9 +42,15 @@ func WithBlocker(f blocker.IBlocker) Option {
 	}
 }
 
-func WithEventReader(ev event.IEventReader) Option {
+// WithEventReader 事件来源, 可多次调用或一次传入多个, 全部来源的事件汇入同一个事件循环处理
+func WithEventReader(evs ...event.IEventReader) Option {
 	return func(c *config) {
-		c.obs = ev
+		for _, ev := range evs {
+			if ev == nil {
+				continue
+			}
+			c.obs = append(c.obs, ev)
+		}
 	}
 }
 
@@ -40,15 +60,17 @@ func WithIPDBDao(d dao.IIPDBDao) Option {
 	}
 }
 
-func WithUserIPBlackList(fs []string) Option {
+// WithUserIPBlackList 用户黑名单目录的监听器, 目录内文件变化时增量更新拦截规则
+func WithUserIPBlackList(w userlist.IWatcher) Option {
 	return func(c *config) {
-		c.userBlackList = fs
+		c.userBlackList = w
 	}
 }
 
-func WithUserIPWhiteList(fs []string) Option {
+// WithUserIPWhiteList 用户白名单目录的监听器, 目录内文件变化时增量更新放行规则
+func WithUserIPWhiteList(w userlist.IWatcher) Option {
 	return func(c *config) {
-		c.userWhiteList = fs
+		c.userWhiteList = w
 	}
 }
 
@@ -72,8 +94,83 @@ func WithBanTime(ts time.Duration) Option {
 	}
 }
 
+// WithBanLadder 按历史被封禁次数逐级加重的封禁时长, 超出长度时使用最后一级, 0表示永久封禁
+func WithBanLadder(ladder []time.Duration) Option {
+	return func(c *config) {
+		c.banLadder = ladder
+	}
+}
+
 func WithDisableLocalNetworkProtect(v bool) Option {
 	return func(c *config) {
 		c.disableLocalNetworkProtect = v
 	}
 }
+
+// WithPersistent 退出时保留拦截规则, 需要配合blocker的持久模式使用
+func WithPersistent(v bool) Option {
+	return func(c *config) {
+		c.persistent = v
+	}
+}
+
+// WithBanScopes 可供规则引用的封禁范围, 规则未引用时封禁全部流量
+func WithBanScopes(scopes ...*blocker.BanScope) Option {
+	return func(c *config) {
+		if c.banScopes == nil {
+			c.banScopes = make(map[string]*blocker.BanScope, len(scopes))
+		}
+		for _, scope := range scopes {
+			c.banScopes[scope.Name] = scope
+		}
+	}
+}
+
+// WithConntrackFlusher 封禁成功后清理来源ip已建立的连接, 不设置时已建立的连接在封禁后依然可用
+func WithConntrackFlusher(f conntrack.IFlusher) Option {
+	return func(c *config) {
+		c.flusher = f
+	}
+}
+
+// WithSubnetEscalation 同一网段内的多个封禁合并为网段封禁, 为nil时不合并
+func WithSubnetEscalation(s *SubnetEscalation) Option {
+	return func(c *config) {
+		c.subnet = s
+	}
+}
+
+// WithCageSize 最大封禁数, 需要与blocker的集合容量保持一致, 0表示不限制
+func WithCageSize(sz uint64) Option {
+	return func(c *config) {
+		c.cageSize = sz
+	}
+}
+
+// WithOverflowPolicy 达到最大封禁数后的处理方式, 可选OverflowReject/OverflowEvict, 默认为OverflowReject
+func WithOverflowPolicy(policy string) Option {
+	return func(c *config) {
+		c.overflowPolicy = policy
+	}
+}
+
+// WithExitIPs 本机出口ip, 来自这些ip的事件不会触发封禁
+func WithExitIPs(ips []string) Option {
+	return func(c *config) {
+		c.exitIPs = ips
+	}
+}
+
+// WithEventHistory 记录每次命中的事件, keep为保留时长, maxRows为最大保留条数, 均为0时不记录
+func WithEventHistory(keep time.Duration, maxRows int64) Option {
+	return func(c *config) {
+		c.historyKeep = keep
+		c.historyMaxRows = maxRows
+	}
+}
+
+func WithRuleEngine(e rule.IRuleEngine) Option {
+	return func(c *config) {
+		c.ruleEngine = e
+	}
+}
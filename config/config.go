@@ -10,27 +10,117 @@ import (
 	"github.com/xxxsen/common/logger"
 )
 
+const (
+	InterfaceAuto = "auto" //展开为所有带默认路由的网卡
+)
+
 type NetConfig struct {
-	Interface string   `json:"interface"`
-	ExitIPs   []string `json:"exit_ips"`
+	Interface  string   `json:"interface"`  //兼容旧配置, 与interfaces合并使用
+	Interfaces []string `json:"interfaces"` //支持特殊值auto
+	ExitIPs    []string `json:"exit_ips"`
+	SnapLen    int32    `json:"snap_len"`
+	Promisc    bool     `json:"promisc"`
+}
+
+type RuleConfig struct {
+	Name          string   `json:"name"`
+	Protocol      string   `json:"protocol"`
+	Ports         []string `json:"ports"`
+	Threshold     int      `json:"threshold"`
+	Window        uint64   `json:"window"`
+	DistinctPorts int      `json:"distinct_ports"`
+	Interfaces    []string `json:"interfaces"`
+	EventTypes    []string `json:"event_types"`
+	Scope         string   `json:"scope"` //引用ban_scopes中的名称, 为空时封禁全部流量
+}
+
+// BanScopeConfig 封禁范围, 仅支持iptables后端
+type BanScopeConfig struct {
+	Name     string   `json:"name"`
+	Protocol string   `json:"protocol"` //tcp/udp, 为空时两者均拦截
+	Ports    []string `json:"ports"`    //为空时拦截该协议的全部端口
+}
+
+type LogRuleConfig struct {
+	Name      string   `json:"name"`
+	Preset    string   `json:"preset"`
+	Files     []string `json:"files"`
+	Patterns  []string `json:"patterns"`
+	Threshold int      `json:"threshold"`
+	Window    uint64   `json:"window"`
+}
+
+// SubnetEscalationConfig 同一网段内多个ip被封禁时合并为网段封禁, threshold为0时不启用
+type SubnetEscalationConfig struct {
+	Threshold  int    `json:"threshold"`
+	Window     uint64 `json:"window"`
+	IPv4Prefix int    `json:"ipv4_prefix"`
+	IPv6Prefix int    `json:"ipv6_prefix"`
+}
+
+// EventHistoryConfig 事件历史的保留策略, 两项均为0时不记录
+type EventHistoryConfig struct {
+	KeepDays uint64 `json:"keep_days"`
+	MaxRows  int64  `json:"max_rows"`
+}
+
+type AdminConfig struct {
+	Listen string `json:"listen"`
+	Token  string `json:"token"`
+}
+
+func (r *RuleConfig) DecodePortList() ([]uint16, error) {
+	return decodePortList(r.Ports)
+}
+
+func (s *BanScopeConfig) DecodePortList() ([]uint16, error) {
+	return decodePortList(s.Ports)
 }
 
 type Config struct {
-	NetConfig                  NetConfig        `json:"net_config"`
-	BlackPortList              []string         `json:"black_port_list"`
-	DBFile                     string           `json:"db_file"`
-	LogConfig                  logger.LogConfig `json:"log_config"`
-	UserIPBlackListDir         string           `json:"user_ip_black_list_dir"`
-	UserIPWhiteListDir         string           `json:"user_ip_white_list_dir"`
-	ViewMode                   bool             `json:"view_mode"`
-	BanTime                    uint64           `json:"ban_time"`
-	DisableLocalNetworkProtect bool             `json:"disable_local_network_protect"`
-	CageSize                   uint64           `json:"cage_size"`
+	NetConfig                  NetConfig              `json:"net_config"`
+	BlackPortList              []string               `json:"black_port_list"`
+	DBFile                     string                 `json:"db_file"`
+	LogConfig                  logger.LogConfig       `json:"log_config"`
+	UserIPBlackListDir         string                 `json:"user_ip_black_list_dir"`
+	UserIPWhiteListDir         string                 `json:"user_ip_white_list_dir"`
+	ViewMode                   bool                   `json:"view_mode"`
+	BanTime                    uint64                 `json:"ban_time"`
+	DisableLocalNetworkProtect bool                   `json:"disable_local_network_protect"`
+	CageSize                   uint64                 `json:"cage_size"`
+	OverflowPolicy             string                 `json:"overflow_policy"`
+	BlockerBackend             string                 `json:"blocker_backend"`
+	IPSetDriver                string                 `json:"ipset_driver"`
+	BanLadder                  []uint64               `json:"ban_ladder"`
+	Rules                      []RuleConfig           `json:"rules"`
+	LogRules                   []LogRuleConfig        `json:"log_rules"`
+	BanScopes                  []BanScopeConfig       `json:"ban_scopes"`
+	SubnetEscalation           SubnetEscalationConfig `json:"subnet_escalation"`
+	EventHistory               EventHistoryConfig     `json:"event_history"`
+	AdminConfig                AdminConfig            `json:"admin_config"`
+	MetricListen               string                 `json:"metric_listen"`
+	Persistent                 bool                   `json:"persistent"`
+	FlushConntrack             bool                   `json:"flush_conntrack"`
+	BanAction                  string                 `json:"ban_action"`
+	TarpitRate                 uint32                 `json:"tarpit_rate"`
+}
+
+// Masked 返回隐藏了敏感字段的副本, 用于输出日志
+func (c *Config) Masked() *Config {
+	rs := *c
+	if len(rs.AdminConfig.Token) > 0 {
+		rs.AdminConfig.Token = "******"
+	}
+	return &rs
 }
 
 func (c *Config) DecodePortList() ([]uint16, error) {
+	return decodePortList(c.BlackPortList)
+}
+
+func decodePortList(lst []string) ([]uint16, error) {
 	m := make(map[uint16]struct{})
-	for _, pstr := range c.BlackPortList {
+	for _, pstr := range lst {
 		ports := strings.Split(pstr, "-")
 		left, err := strconv.ParseUint(ports[0], 10, 64)
 		if err != nil {
@@ -63,8 +153,18 @@ func Parse(f string) (*Config, error) {
 		return nil, err
 	}
 	c := &Config{
-		BanTime:  3 * 30 * 86400, // 90d
-		CageSize: 100000,
+		NetConfig: NetConfig{
+			SnapLen: 1600,
+			Promisc: true,
+		},
+		BanTime:        3 * 30 * 86400, // 90d
+		CageSize:       100000,
+		BlockerBackend: "iptables",
+		IPSetDriver:    "auto",
+		EventHistory: EventHistoryConfig{
+			KeepDays: 30,
+			MaxRows:  1000000,
+		},
 	}
 	if err := json.Unmarshal(raw, c); err != nil {
 		return nil, err
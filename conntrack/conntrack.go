@@ -0,0 +1,91 @@
+package conntrack
+
+import (
+	"context"
+	"fmt"
+	"ip-blackcage/utils"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Match 限定需要清理的连接, Port不为0时需要同时指定Protocol
+type Match struct {
+	Protocol string //tcp/udp, 为空时不限制协议
+	Port     uint16 //原始方向的目标端口, 为0时不限制端口
+}
+
+type IFlusher interface {
+	// Flush 删除来源为ip(或者cidr)的连接跟踪条目, matches为空时删除该ip的全部条目, 返回删除的条目数
+	Flush(ctx context.Context, ip string, matches ...*Match) (uint, error)
+}
+
+type netlinkFlusher struct {
+	h *netlink.Handle
+}
+
+func NewFlusher() (IFlusher, error) {
+	h, err := netlink.NewHandle(unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("open netfilter netlink handle failed, err:%w", err)
+	}
+	return &netlinkFlusher{h: h}, nil
+}
+
+func toProtoNum(proto string) (uint8, error) {
+	switch proto {
+	case "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	default:
+		return 0, fmt.Errorf("unsupported protocol:%s", proto)
+	}
+}
+
+// buildFilters 每个Match对应一个过滤器, 过滤器之间为或的关系
+func buildFilters(ipnet *net.IPNet, matches []*Match) ([]netlink.CustomConntrackFilter, error) {
+	if len(matches) == 0 {
+		matches = []*Match{{}}
+	}
+	rs := make([]netlink.CustomConntrackFilter, 0, len(matches))
+	for _, m := range matches {
+		filter := &netlink.ConntrackFilter{}
+		if err := filter.AddIPNet(netlink.ConntrackOrigSrcIP, ipnet); err != nil {
+			return nil, err
+		}
+		if len(m.Protocol) > 0 {
+			proto, err := toProtoNum(m.Protocol)
+			if err != nil {
+				return nil, err
+			}
+			if err := filter.AddProtocol(proto); err != nil {
+				return nil, err
+			}
+		}
+		if m.Port != 0 {
+			if err := filter.AddPort(netlink.ConntrackOrigDstPort, m.Port); err != nil {
+				return nil, err
+			}
+		}
+		rs = append(rs, filter)
+	}
+	return rs, nil
+}
+
+func (f *netlinkFlusher) Flush(_ context.Context, ip string, matches ...*Match) (uint, error) {
+	ipnet, err := utils.ParseIPNet(ip)
+	if err != nil {
+		return 0, err
+	}
+	family := netlink.InetFamily(unix.AF_INET)
+	if ipnet.IP.To4() == nil {
+		family = netlink.InetFamily(unix.AF_INET6)
+	}
+	filters, err := buildFilters(ipnet, matches)
+	if err != nil {
+		return 0, err
+	}
+	return f.h.ConntrackDeleteFilters(netlink.ConntrackTable, family, filters...)
+}
@@ -0,0 +1,59 @@
+package conntrack
+
+import (
+	"ip-blackcage/utils"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+)
+
+func newFlow(src string, proto uint8, dport uint16) *netlink.ConntrackFlow {
+	return &netlink.ConntrackFlow{
+		FamilyType: netlink.FAMILY_V4,
+		Forward: netlink.IPTuple{
+			SrcIP:    net.ParseIP(src),
+			DstIP:    net.ParseIP("10.0.0.1"),
+			Protocol: proto,
+			SrcPort:  40000,
+			DstPort:  dport,
+		},
+	}
+}
+
+func matchAny(filters []netlink.CustomConntrackFilter, flow *netlink.ConntrackFlow) bool {
+	for _, f := range filters {
+		if f.MatchConntrackFlow(flow) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBuildFilters(t *testing.T) {
+	ip, err := utils.ParseIPNet("1.2.3.4")
+	assert.NoError(t, err)
+	filters, err := buildFilters(ip, nil)
+	assert.NoError(t, err)
+	assert.True(t, matchAny(filters, newFlow("1.2.3.4", 17, 53)))
+	assert.False(t, matchAny(filters, newFlow("5.6.7.8", 6, 22)))
+
+	filters, err = buildFilters(ip, []*Match{{Protocol: "tcp", Port: 22}, {Protocol: "udp"}})
+	assert.NoError(t, err)
+	assert.True(t, matchAny(filters, newFlow("1.2.3.4", 6, 22)))
+	assert.True(t, matchAny(filters, newFlow("1.2.3.4", 17, 53)))
+	assert.False(t, matchAny(filters, newFlow("1.2.3.4", 6, 80)))
+
+	subnet, err := utils.ParseIPNet("1.2.3.0/24")
+	assert.NoError(t, err)
+	filters, err = buildFilters(subnet, nil)
+	assert.NoError(t, err)
+	assert.True(t, matchAny(filters, newFlow("1.2.3.99", 6, 22)))
+	assert.False(t, matchAny(filters, newFlow("1.2.4.1", 6, 22)))
+
+	_, err = buildFilters(ip, []*Match{{Port: 22}})
+	assert.Error(t, err)
+	_, err = buildFilters(ip, []*Match{{Protocol: "icmp"}})
+	assert.Error(t, err)
+}
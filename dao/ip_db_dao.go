@@ -15,12 +15,22 @@ import (
 type ListBlackIPCallback func(ctx context.Context, ips []*model.BlackCageTab) error
 
 type IIPDBDao interface {
-	AddBlackIP(ctx context.Context, ip string, remark string) error
-	IncrBlackIPVisit(ctx context.Context, ip string) error
+	AddBlackIP(ctx context.Context, item *model.BlackCageTab) error
+	SetBlackIPExpire(ctx context.Context, ip string, expireAt uint64) error
+	IncrBlackIPVisitBatch(ctx context.Context, visits []*model.BlackIPVisit) error
 	GetBlackIP(ctx context.Context, ip string) (*model.BlackCageTab, bool, error)
 	DelBlackIP(ctx context.Context, ip string) (bool, error)
 	ScanBlackIP(ctx context.Context, limit int, cb ListBlackIPCallback) (int64, error)
 	ListBlackIP(ctx context.Context, cond *model.ListBlackIPCondition, offset, limit int64) ([]*model.BlackCageTab, error)
+	// ListEvictCandidates 按访问次数及最后访问时间升序返回非永久封禁的记录, 用于容量不足时淘汰, scopes不为nil时只返回对应封禁范围的记录
+	ListEvictCandidates(ctx context.Context, scopes []string, limit int64) ([]*model.BlackCageTab, error)
+	GetOffense(ctx context.Context, ip string) (*model.OffenseTab, bool, error)
+	IncrOffense(ctx context.Context, ip string) error
+	AddEventHistoryBatch(ctx context.Context, items []*model.EventHistoryTab) error
+	// ListEventHistory 按事件时间倒序分页查询事件记录
+	ListEventHistory(ctx context.Context, cond *model.ListEventHistoryCondition, offset, limit int64) ([]*model.EventHistoryTab, error)
+	// CleanEventHistory 移除ts早于before的记录, 并只保留最新的maxRows条, 参数为0时不限制
+	CleanEventHistory(ctx context.Context, before uint64, maxRows int64) (int64, error)
 }
 
 type ipDBDaoImpl struct {
@@ -34,7 +44,7 @@ func NewIPDBDao() (IIPDBDao, error) {
 	if err := impl.init(); err != nil {
 		return nil, err
 	}
-	return impl, nil
+	return newMetricDao(impl), nil
 }
 
 func (d *ipDBDaoImpl) getClient(ctx context.Context) database.IDatabase {
@@ -42,34 +52,8 @@ func (d *ipDBDaoImpl) getClient(ctx context.Context) database.IDatabase {
 }
 
 func (d *ipDBDaoImpl) init() error {
-	initItems := []struct {
-		name string
-		sql  string
-	}{
-		{
-			name: "create table",
-			sql: `
-CREATE TABLE IF NOT EXISTS ip_blackcage_tab (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    remark TEXT NOT NULL,
-    ctime INTEGER NOT NULL,
-    mtime INTEGER NOT NULL,
-    ip TEXT NOT NULL UNIQUE,
-	counter INTEGER NOT NULL
-);
-`,
-		},
-		{
-			name: "add_mtime_index",
-			sql:  "CREATE INDEX IF NOT EXISTS idx_mtime ON ip_blackcage_tab(mtime);",
-		},
-	}
-	for _, item := range initItems {
-		if _, err := d.getClient(context.Background()).
-			ExecContext(context.Background(), item.sql); err != nil {
-
-			return fmt.Errorf("exec sql failed, job:%s, err:%w", item.name, err)
-		}
+	if err := migrate(context.Background(), d.getClient(context.Background()), migrations); err != nil {
+		return fmt.Errorf("migrate db failed, err:%w", err)
 	}
 	return nil
 }
@@ -78,26 +62,50 @@ func (d *ipDBDaoImpl) table() string {
 	return "ip_blackcage_tab"
 }
 
-func (d *ipDBDaoImpl) AddBlackIP(ctx context.Context, ip string, remark string) error {
+func (d *ipDBDaoImpl) offenseTable() string {
+	return "ip_offense_tab"
+}
+
+func (d *ipDBDaoImpl) historyTable() string {
+	return "ip_event_history_tab"
+}
+
+func (d *ipDBDaoImpl) AddBlackIP(ctx context.Context, item *model.BlackCageTab) error {
 	client := d.getClient(ctx)
 	now := time.Now().UnixMilli()
-	sql := fmt.Sprintf(`insert or ignore into %s(remark, ctime, mtime, ip, counter) values(?, ?, ?, ?, ?)`, d.table())
-	if _, err := client.ExecContext(ctx, sql, remark, now, now, ip, 1); err != nil {
+	sql := fmt.Sprintf(`insert or ignore into %s(remark, ctime, mtime, ip, counter, expire_at, scope, reason, event_type, rule, protocol, dst_port, iface)
+values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, d.table())
+	if _, err := client.ExecContext(ctx, sql, item.Remark, now, now, item.IP, 1, item.ExpireAt, item.Scope,
+		item.Reason, item.EventType, item.Rule, item.Protocol, item.DstPort, item.Iface); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (d *ipDBDaoImpl) IncrBlackIPVisit(ctx context.Context, ip string) error {
+func (d *ipDBDaoImpl) SetBlackIPExpire(ctx context.Context, ip string, expireAt uint64) error {
 	client := d.getClient(ctx)
-	now := time.Now().UnixMilli()
-	sql := fmt.Sprintf("update %s set counter = counter + 1, mtime = ? where ip = ?", d.table())
-	if _, err := client.ExecContext(ctx, sql, now, ip); err != nil {
+	sql := fmt.Sprintf("update %s set expire_at = ? where ip = ?", d.table())
+	if _, err := client.ExecContext(ctx, sql, expireAt, ip); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (d *ipDBDaoImpl) IncrBlackIPVisitBatch(ctx context.Context, visits []*model.BlackIPVisit) error {
+	if len(visits) == 0 {
+		return nil
+	}
+	sql := fmt.Sprintf("update %s set counter = counter + ?, mtime = max(mtime, ?) where ip = ?", d.table())
+	return d.getClient(ctx).OnTransation(ctx, func(ctx context.Context, qe database.IQueryExecer) error {
+		for _, v := range visits {
+			if _, err := qe.ExecContext(ctx, sql, v.Count, v.MTime, v.IP); err != nil {
+				return fmt.Errorf("update visit of ip:%s failed, err:%w", v.IP, err)
+			}
+		}
+		return nil
+	})
+}
+
 func (d *ipDBDaoImpl) GetBlackIP(ctx context.Context, ip string) (*model.BlackCageTab, bool, error) {
 	where := map[string]interface{}{
 		"ip":     ip,
@@ -146,6 +154,29 @@ func (d *ipDBDaoImpl) ListBlackIP(ctx context.Context,
 		where["mtime >="] = cond.MtimeBetween[0]
 		where["mtime <"] = cond.MtimeBetween[1]
 	}
+	if len(cond.IPPrefix) > 0 {
+		where["ip like"] = cond.IPPrefix + "%"
+	}
+	rs := make([]*model.BlackCageTab, 0, limit)
+	if err := dbkit.SimpleQuery(ctx, d.getClient(ctx), d.table(), where, &rs, dbkit.ScanWithTagName("json")); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (d *ipDBDaoImpl) ListEvictCandidates(ctx context.Context, scopes []string, limit int64) ([]*model.BlackCageTab, error) {
+	where := map[string]interface{}{
+		"expire_at !=": model.ExpireAtPermanent,
+		"_orderby":     "counter asc, mtime asc",
+		"_limit":       []uint{0, uint(limit)},
+	}
+	if scopes != nil {
+		in := make([]interface{}, 0, len(scopes))
+		for _, scope := range scopes {
+			in = append(in, scope)
+		}
+		where["scope in"] = in
+	}
 	rs := make([]*model.BlackCageTab, 0, limit)
 	if err := dbkit.SimpleQuery(ctx, d.getClient(ctx), d.table(), where, &rs, dbkit.ScanWithTagName("json")); err != nil {
 		return nil, err
@@ -188,3 +219,92 @@ func (d *ipDBDaoImpl) selectByScan(ctx context.Context, id int64, limit int) ([]
 	}
 	return rs, nil
 }
+
+func (d *ipDBDaoImpl) GetOffense(ctx context.Context, ip string) (*model.OffenseTab, bool, error) {
+	where := map[string]interface{}{
+		"ip":     ip,
+		"_limit": []uint{0, 1},
+	}
+	rs := make([]*model.OffenseTab, 0, 1)
+	client := d.getClient(ctx)
+	if err := dbkit.SimpleQuery(ctx, client, d.offenseTable(), where, &rs, dbkit.ScanWithTagName("json")); err != nil {
+		return nil, false, err
+	}
+	if len(rs) == 0 {
+		return nil, false, nil
+	}
+	return rs[0], true, nil
+}
+
+func (d *ipDBDaoImpl) IncrOffense(ctx context.Context, ip string) error {
+	client := d.getClient(ctx)
+	now := time.Now().UnixMilli()
+	sql := fmt.Sprintf(`insert into %s(ip, ban_count, ctime, mtime) values(?, 1, ?, ?)
+on conflict(ip) do update set ban_count = ban_count + 1, mtime = excluded.mtime`, d.offenseTable())
+	if _, err := client.ExecContext(ctx, sql, ip, now, now); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *ipDBDaoImpl) AddEventHistoryBatch(ctx context.Context, items []*model.EventHistoryTab) error {
+	if len(items) == 0 {
+		return nil
+	}
+	sql := fmt.Sprintf(`insert into %s(ts, event_type, protocol, src_ip, src_port, dst_ip, dst_port, iface, rule, action, detail, count)
+values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, d.historyTable())
+	return d.getClient(ctx).OnTransation(ctx, func(ctx context.Context, qe database.IQueryExecer) error {
+		for _, item := range items {
+			if _, err := qe.ExecContext(ctx, sql, item.TS, item.EventType, item.Protocol, item.SrcIP, item.SrcPort,
+				item.DstIP, item.DstPort, item.Iface, item.Rule, item.Action, item.Detail, item.Count); err != nil {
+				return fmt.Errorf("insert event history of ip:%s failed, err:%w", item.SrcIP, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (d *ipDBDaoImpl) ListEventHistory(ctx context.Context,
+	cond *model.ListEventHistoryCondition, offset, limit int64) ([]*model.EventHistoryTab, error) {
+	where := map[string]interface{}{
+		"_orderby": "ts desc, id desc",
+		"_limit":   []uint{uint(offset), uint(limit)},
+	}
+	if len(cond.SrcIP) > 0 {
+		where["src_ip"] = cond.SrcIP
+	}
+	rs := make([]*model.EventHistoryTab, 0, limit)
+	if err := dbkit.SimpleQuery(ctx, d.getClient(ctx), d.historyTable(), where, &rs, dbkit.ScanWithTagName("json")); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (d *ipDBDaoImpl) CleanEventHistory(ctx context.Context, before uint64, maxRows int64) (int64, error) {
+	client := d.getClient(ctx)
+	var total int64
+	if before > 0 {
+		rs, err := client.ExecContext(ctx, fmt.Sprintf("delete from %s where ts < ?", d.historyTable()), before)
+		if err != nil {
+			return 0, err
+		}
+		cnt, err := rs.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		total += cnt
+	}
+	if maxRows > 0 {
+		sql := fmt.Sprintf("delete from %s where id <= (select id from %s order by id desc limit 1 offset ?)", d.historyTable(), d.historyTable())
+		rs, err := client.ExecContext(ctx, sql, maxRows)
+		if err != nil {
+			return 0, err
+		}
+		cnt, err := rs.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		total += cnt
+	}
+	return total, nil
+}
@@ -6,6 +6,7 @@ import (
 	"ip-blackcage/model"
 	"os"
 	"testing"
+	"time"
 
 	_ "github.com/glebarez/go-sqlite"
 	"github.com/stretchr/testify/assert"
@@ -22,9 +23,9 @@ func TestIPDBDao(t *testing.T) {
 	{ //插入数据
 		ips := []string{"1.2.3.4", "2.3.4.5", "3.4.5.6"} //duplicate
 		for _, ip := range ips {
-			err := d.AddBlackIP(ctx, ip, "test")
+			err := d.AddBlackIP(ctx, &model.BlackCageTab{IP: ip, Remark: "test", ExpireAt: model.ExpireAtPermanent})
 			assert.NoError(t, err)
-			err = d.IncrBlackIPVisit(ctx, ip)
+			err = d.IncrBlackIPVisitBatch(ctx, []*model.BlackIPVisit{{IP: ip, Count: 1, MTime: 1}})
 			assert.NoError(t, err)
 		}
 	}
@@ -45,6 +46,72 @@ func TestIPDBDao(t *testing.T) {
 		assert.NoError(t, err)
 		assert.True(t, ok)
 		assert.Equal(t, "1.2.3.4", info.IP)
+		assert.Equal(t, model.ExpireAtPermanent, info.ExpireAt)
+		assert.Equal(t, "", info.Scope)
+	}
+	{ //带封禁范围的记录
+		err := d.AddBlackIP(ctx, &model.BlackCageTab{IP: "4.5.6.7", Scope: "ssh", ExpireAt: model.ExpireAtPermanent,
+			Reason: model.BanReasonEvent, EventType: "port_scan", Rule: "burst", Protocol: "tcp", DstPort: 22, Iface: "eth0"})
+		assert.NoError(t, err)
+		info, ok, err := d.GetBlackIP(ctx, "4.5.6.7")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "ssh", info.Scope)
+		assert.Equal(t, model.BanReasonEvent, info.Reason)
+		assert.Equal(t, "burst", info.Rule)
+		assert.Equal(t, uint64(22), info.DstPort)
+		assert.Equal(t, "eth0", info.Iface)
+		_, err = d.DelBlackIP(ctx, "4.5.6.7")
+		assert.NoError(t, err)
+	}
+	{ //修改过期时间
+		err := d.SetBlackIPExpire(ctx, "2.3.4.5", 12345)
+		assert.NoError(t, err)
+		info, ok, err := d.GetBlackIP(ctx, "2.3.4.5")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(12345), info.ExpireAt)
+	}
+	{ //批量更新访问计数
+		mtime := uint64(time.Now().Add(time.Hour).UnixMilli())
+		err := d.IncrBlackIPVisitBatch(ctx, []*model.BlackIPVisit{
+			{IP: "3.4.5.6", Count: 10, MTime: mtime},
+			{IP: "9.9.9.9", Count: 1, MTime: mtime}, //不存在的ip
+		})
+		assert.NoError(t, err)
+		info, ok, err := d.GetBlackIP(ctx, "3.4.5.6")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int64(12), info.Counter)
+		assert.Equal(t, mtime, info.MTime)
+		_, ok, err = d.GetBlackIP(ctx, "9.9.9.9")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		//较旧的mtime不会覆盖已有值
+		err = d.IncrBlackIPVisitBatch(ctx, []*model.BlackIPVisit{{IP: "3.4.5.6", Count: 1, MTime: 1}})
+		assert.NoError(t, err)
+		info, _, err = d.GetBlackIP(ctx, "3.4.5.6")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(13), info.Counter)
+		assert.Equal(t, mtime, info.MTime)
+	}
+	{ //按前缀搜索
+		rs, err := d.ListBlackIP(ctx, &model.ListBlackIPCondition{IPPrefix: "2.3."}, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(rs))
+		assert.Equal(t, "2.3.4.5", rs[0].IP)
+	}
+	{ //淘汰候选, 永久封禁的记录不参与淘汰
+		rs, err := d.ListEvictCandidates(ctx, nil, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(rs))
+		assert.Equal(t, "2.3.4.5", rs[0].IP)
+		rs, err = d.ListEvictCandidates(ctx, []string{"ssh"}, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(rs))
+		rs, err = d.ListEvictCandidates(ctx, []string{""}, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(rs))
 	}
 	{ //删除再获取
 		ok, err := d.DelBlackIP(ctx, "1.2.3.4")
@@ -54,4 +121,55 @@ func TestIPDBDao(t *testing.T) {
 		assert.NoError(t, err)
 		assert.False(t, ok)
 	}
+	{ //违规记录
+		_, ok, err := d.GetOffense(ctx, "1.2.3.4")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		for i := 0; i < 3; i++ {
+			err = d.IncrOffense(ctx, "1.2.3.4")
+			assert.NoError(t, err)
+		}
+		info, ok, err := d.GetOffense(ctx, "1.2.3.4")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int64(3), info.BanCount)
+	}
+}
+
+func TestEventHistory(t *testing.T) {
+	path := "/tmp/ip_history_test.db"
+	defer os.Remove(path)
+	db.InitDB(path)
+
+	d, err := NewIPDBDao()
+	assert.NoError(t, err)
+	ctx := context.Background()
+	items := make([]*model.EventHistoryTab, 0, 10)
+	for i := 0; i < 10; i++ {
+		ip := "1.2.3.4"
+		if i%2 == 1 {
+			ip = "5.6.7.8"
+		}
+		items = append(items, &model.EventHistoryTab{TS: uint64(1000 + i), EventType: "port_scan", Protocol: "tcp",
+			SrcIP: ip, SrcPort: 40000, DstIP: "10.0.0.1", DstPort: 22, Iface: "eth0", Action: model.HistoryActionPass, Count: int64(i + 1)})
+	}
+	assert.NoError(t, d.AddEventHistoryBatch(ctx, items))
+	rs, err := d.ListEventHistory(ctx, &model.ListEventHistoryCondition{SrcIP: "1.2.3.4"}, 0, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(rs))
+	assert.Equal(t, uint64(1008), rs[0].TS) //按时间倒序
+	assert.Equal(t, uint64(22), rs[0].DstPort)
+	assert.Equal(t, int64(9), rs[0].Count)
+	//按时间清理
+	cnt, err := d.CleanEventHistory(ctx, 1002, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), cnt)
+	//按条数清理, 保留最新的3条
+	cnt, err = d.CleanEventHistory(ctx, 0, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), cnt)
+	rs, err = d.ListEventHistory(ctx, &model.ListEventHistoryCondition{}, 0, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(rs))
+	assert.Equal(t, uint64(1007), rs[2].TS)
 }
@@ -0,0 +1,100 @@
+package dao
+
+import (
+	"context"
+	"ip-blackcage/metrics"
+	"ip-blackcage/model"
+)
+
+// metricDao 统计DB操作的失败次数
+type metricDao struct {
+	impl IIPDBDao
+}
+
+func newMetricDao(impl IIPDBDao) IIPDBDao {
+	return &metricDao{impl: impl}
+}
+
+func (d *metricDao) observe(op string, err error) {
+	if err != nil {
+		metrics.DBErrors.WithLabelValues(op).Inc()
+	}
+}
+
+func (d *metricDao) AddBlackIP(ctx context.Context, item *model.BlackCageTab) error {
+	err := d.impl.AddBlackIP(ctx, item)
+	d.observe("add_black_ip", err)
+	return err
+}
+
+func (d *metricDao) SetBlackIPExpire(ctx context.Context, ip string, expireAt uint64) error {
+	err := d.impl.SetBlackIPExpire(ctx, ip, expireAt)
+	d.observe("set_black_ip_expire", err)
+	return err
+}
+
+func (d *metricDao) IncrBlackIPVisitBatch(ctx context.Context, visits []*model.BlackIPVisit) error {
+	err := d.impl.IncrBlackIPVisitBatch(ctx, visits)
+	d.observe("incr_black_ip_visit_batch", err)
+	return err
+}
+
+func (d *metricDao) GetBlackIP(ctx context.Context, ip string) (*model.BlackCageTab, bool, error) {
+	rs, ok, err := d.impl.GetBlackIP(ctx, ip)
+	d.observe("get_black_ip", err)
+	return rs, ok, err
+}
+
+func (d *metricDao) DelBlackIP(ctx context.Context, ip string) (bool, error) {
+	ok, err := d.impl.DelBlackIP(ctx, ip)
+	d.observe("del_black_ip", err)
+	return ok, err
+}
+
+func (d *metricDao) ScanBlackIP(ctx context.Context, limit int, cb ListBlackIPCallback) (int64, error) {
+	cnt, err := d.impl.ScanBlackIP(ctx, limit, cb)
+	d.observe("scan_black_ip", err)
+	return cnt, err
+}
+
+func (d *metricDao) ListBlackIP(ctx context.Context, cond *model.ListBlackIPCondition, offset, limit int64) ([]*model.BlackCageTab, error) {
+	rs, err := d.impl.ListBlackIP(ctx, cond, offset, limit)
+	d.observe("list_black_ip", err)
+	return rs, err
+}
+
+func (d *metricDao) ListEvictCandidates(ctx context.Context, scopes []string, limit int64) ([]*model.BlackCageTab, error) {
+	rs, err := d.impl.ListEvictCandidates(ctx, scopes, limit)
+	d.observe("list_evict_candidates", err)
+	return rs, err
+}
+
+func (d *metricDao) GetOffense(ctx context.Context, ip string) (*model.OffenseTab, bool, error) {
+	rs, ok, err := d.impl.GetOffense(ctx, ip)
+	d.observe("get_offense", err)
+	return rs, ok, err
+}
+
+func (d *metricDao) IncrOffense(ctx context.Context, ip string) error {
+	err := d.impl.IncrOffense(ctx, ip)
+	d.observe("incr_offense", err)
+	return err
+}
+
+func (d *metricDao) AddEventHistoryBatch(ctx context.Context, items []*model.EventHistoryTab) error {
+	err := d.impl.AddEventHistoryBatch(ctx, items)
+	d.observe("add_event_history_batch", err)
+	return err
+}
+
+func (d *metricDao) ListEventHistory(ctx context.Context, cond *model.ListEventHistoryCondition, offset, limit int64) ([]*model.EventHistoryTab, error) {
+	rs, err := d.impl.ListEventHistory(ctx, cond, offset, limit)
+	d.observe("list_event_history", err)
+	return rs, err
+}
+
+func (d *metricDao) CleanEventHistory(ctx context.Context, before uint64, maxRows int64) (int64, error) {
+	cnt, err := d.impl.CleanEventHistory(ctx, before, maxRows)
+	d.observe("clean_event_history", err)
+	return cnt, err
+}
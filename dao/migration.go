@@ -0,0 +1,232 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/xxxsen/common/database"
+)
+
+const (
+	schemaVersionTable = "ip_schema_version_tab"
+)
+
+var (
+	errSchemaTooNew = errors.New("db schema is newer than binary")
+)
+
+// migration 一次结构变更, version从1开始连续递增, 已发布的迁移不允许修改, 新的变更只能追加到末尾
+// 引入版本表之前的部署可能已经包含部分表/字段, 因此迁移需要保证可重复执行
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, qe database.IQueryExecer) error
+}
+
+func execSQLs(sqls ...string) func(ctx context.Context, qe database.IQueryExecer) error {
+	return func(ctx context.Context, qe database.IQueryExecer) error {
+		for _, sql := range sqls {
+			if _, err := qe.ExecContext(ctx, sql); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+type columnDef struct {
+	name string
+	def  string
+}
+
+func addColumns(table string, cols ...columnDef) func(ctx context.Context, qe database.IQueryExecer) error {
+	return func(ctx context.Context, qe database.IQueryExecer) error {
+		for _, col := range cols {
+			if err := ensureColumn(ctx, qe, table, col.name, col.def); err != nil {
+				return fmt.Errorf("ensure %s column failed, err:%w", col.name, err)
+			}
+		}
+		return nil
+	}
+}
+
+var migrations = []*migration{
+	{
+		version: 1,
+		name:    "create black ip table",
+		up: execSQLs(`
+CREATE TABLE IF NOT EXISTS ip_blackcage_tab (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    remark TEXT NOT NULL,
+    ctime INTEGER NOT NULL,
+    mtime INTEGER NOT NULL,
+    ip TEXT NOT NULL UNIQUE,
+	counter INTEGER NOT NULL
+);
+`, "CREATE INDEX IF NOT EXISTS idx_mtime ON ip_blackcage_tab(mtime);"),
+	},
+	{
+		version: 2,
+		name:    "add expire_at column",
+		up: func(ctx context.Context, qe database.IQueryExecer) error {
+			if err := addColumns("ip_blackcage_tab", columnDef{"expire_at", "INTEGER NOT NULL DEFAULT 0"})(ctx, qe); err != nil {
+				return err
+			}
+			return execSQLs("CREATE INDEX IF NOT EXISTS idx_expire_at ON ip_blackcage_tab(expire_at);")(ctx, qe)
+		},
+	},
+	{
+		version: 3,
+		name:    "create offense table",
+		up: execSQLs(`
+CREATE TABLE IF NOT EXISTS ip_offense_tab (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ip TEXT NOT NULL UNIQUE,
+    ban_count INTEGER NOT NULL,
+    ctime INTEGER NOT NULL,
+    mtime INTEGER NOT NULL
+);
+`),
+	},
+	{
+		version: 4,
+		name:    "add scope column",
+		up:      addColumns("ip_blackcage_tab", columnDef{"scope", "TEXT NOT NULL DEFAULT ''"}),
+	},
+	{
+		version: 5,
+		name:    "add structured reason columns",
+		up: addColumns("ip_blackcage_tab",
+			columnDef{"reason", "TEXT NOT NULL DEFAULT ''"},
+			columnDef{"event_type", "TEXT NOT NULL DEFAULT ''"},
+			columnDef{"rule", "TEXT NOT NULL DEFAULT ''"},
+			columnDef{"protocol", "TEXT NOT NULL DEFAULT ''"},
+			columnDef{"dst_port", "INTEGER NOT NULL DEFAULT 0"},
+			columnDef{"iface", "TEXT NOT NULL DEFAULT ''"},
+		),
+	},
+	{
+		version: 6,
+		name:    "create event history table",
+		up: execSQLs(`
+CREATE TABLE IF NOT EXISTS ip_event_history_tab (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ts INTEGER NOT NULL,
+    event_type TEXT NOT NULL,
+    protocol TEXT NOT NULL,
+    src_ip TEXT NOT NULL,
+    src_port INTEGER NOT NULL,
+    dst_ip TEXT NOT NULL,
+    dst_port INTEGER NOT NULL,
+    iface TEXT NOT NULL,
+    rule TEXT NOT NULL,
+    action TEXT NOT NULL,
+    detail TEXT NOT NULL
+);
+`,
+			"CREATE INDEX IF NOT EXISTS idx_history_src_ip_ts ON ip_event_history_tab(src_ip, ts);",
+			"CREATE INDEX IF NOT EXISTS idx_history_ts ON ip_event_history_tab(ts);"),
+	},
+	{
+		version: 7,
+		name:    "add event history count column",
+		up:      addColumns("ip_event_history_tab", columnDef{"count", "INTEGER NOT NULL DEFAULT 1"}),
+	},
+}
+
+func validateMigrations(items []*migration) error {
+	for idx, item := range items {
+		if item.version != idx+1 {
+			return fmt.Errorf("migration version should be continuous, idx:%d, version:%d, name:%s", idx, item.version, item.name)
+		}
+	}
+	return nil
+}
+
+func currentSchemaVersion(ctx context.Context, qe database.IQueryExecer) (int, error) {
+	rows, err := qe.QueryContext(ctx, fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s", schemaVersionTable))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var version int
+	if rows.Next() {
+		if err := rows.Scan(&version); err != nil {
+			return 0, err
+		}
+	}
+	return version, rows.Err()
+}
+
+// migrate 按版本顺序执行尚未应用的迁移, 每个迁移与其版本记录在同一个事务中提交
+// DB版本高于当前程序支持的版本时(例如回滚了程序)拒绝启动, 避免旧程序写坏新结构的数据
+func migrate(ctx context.Context, client database.IDatabase, items []*migration) error {
+	if err := validateMigrations(items); err != nil {
+		return err
+	}
+	sql := fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    ctime INTEGER NOT NULL
+);
+`, schemaVersionTable)
+	if _, err := client.ExecContext(ctx, sql); err != nil {
+		return fmt.Errorf("create schema version table failed, err:%w", err)
+	}
+	current, err := currentSchemaVersion(ctx, client)
+	if err != nil {
+		return fmt.Errorf("read schema version failed, err:%w", err)
+	}
+	latest := len(items)
+	if current > latest {
+		return fmt.Errorf("%w, db version:%d, binary version:%d", errSchemaTooNew, current, latest)
+	}
+	for _, item := range items[current:] {
+		err := client.OnTransation(ctx, func(ctx context.Context, qe database.IQueryExecer) error {
+			if err := item.up(ctx, qe); err != nil {
+				return err
+			}
+			_, err := qe.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s(version, name, ctime) VALUES(?, ?, ?)", schemaVersionTable),
+				item.version, item.name, time.Now().UnixMilli())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("apply migration failed, version:%d, name:%s, err:%w", item.version, item.name, err)
+		}
+	}
+	return nil
+}
+
+// ensureColumn sqlite不支持ADD COLUMN IF NOT EXISTS, 先通过table_info检查字段是否存在
+func ensureColumn(ctx context.Context, qe database.IQueryExecer, table string, column string, def string) error {
+	rows, err := qe.QueryContext(ctx, fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return err
+	}
+	exist := false
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == column {
+			exist = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if exist {
+		return nil
+	}
+	sql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def)
+	if _, err := qe.ExecContext(ctx, sql); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package dao
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xxxsen/common/database/sqlite"
+)
+
+func TestMigrate(t *testing.T) {
+	path := "/tmp/ip_db_migrate_test.db"
+	defer os.Remove(path)
+	client, err := sqlite.New(path)
+	assert.NoError(t, err)
+	defer client.Close()
+	ctx := context.Background()
+	//引入版本表之前的部署, 只有最初的表结构
+	_, err = client.ExecContext(ctx, `CREATE TABLE ip_blackcage_tab (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    remark TEXT NOT NULL,
+    ctime INTEGER NOT NULL,
+    mtime INTEGER NOT NULL,
+    ip TEXT NOT NULL UNIQUE,
+	counter INTEGER NOT NULL
+);`)
+	assert.NoError(t, err)
+	_, err = client.ExecContext(ctx, "INSERT INTO ip_blackcage_tab(remark, ctime, mtime, ip, counter) VALUES('old', 1, 1, '1.2.3.4', 1)")
+	assert.NoError(t, err)
+
+	assert.NoError(t, migrate(ctx, client, migrations))
+	version, err := currentSchemaVersion(ctx, client)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+	rows, err := client.QueryContext(ctx, "SELECT ip, expire_at, scope, reason FROM ip_blackcage_tab")
+	assert.NoError(t, err)
+	assert.True(t, rows.Next())
+	var ip, scope, reason string
+	var expireAt uint64
+	assert.NoError(t, rows.Scan(&ip, &expireAt, &scope, &reason))
+	rows.Close()
+	assert.Equal(t, "1.2.3.4", ip)
+	assert.Equal(t, uint64(0), expireAt)
+
+	//重复执行不会再次应用
+	assert.NoError(t, migrate(ctx, client, migrations))
+
+	//迁移失败时版本不前进
+	broken := append(append([]*migration{}, migrations...), &migration{version: len(migrations) + 1, name: "broken", up: execSQLs("ALTER TABLE no_such_tab ADD COLUMN x INTEGER")})
+	assert.Error(t, migrate(ctx, client, broken))
+	version, err = currentSchemaVersion(ctx, client)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+
+	//DB版本高于程序时拒绝启动
+	assert.ErrorIs(t, migrate(ctx, client, migrations[:len(migrations)-1]), errSchemaTooNew)
+
+	//版本号必须连续
+	assert.Error(t, validateMigrations([]*migration{{version: 1}, {version: 3}}))
+}
@@ -31,5 +31,10 @@ func NewEventData(typ string, ts int64, data interface{}) IEventData {
 }
 
 type IEventReader interface {
+	// Name 来源名称, 用于区分各来源的监控指标
+	Name() string
+	// Open 开始读取事件, ctx被取消时等同于调用Close
 	Open(ctx context.Context) (<-chan IEventData, error)
+	// Close 停止读取, 全部在途事件写入后关闭Open返回的channel, 可重复调用
+	Close() error
 }
@@ -4,4 +4,5 @@ type EventType string
 
 const (
 	EventTypePortScan EventType = "port_scan"
+	EventTypeLogMatch EventType = "log_match"
 )
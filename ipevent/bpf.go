@@ -0,0 +1,62 @@
+package ipevent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// buildPortExpr 将端口列表压缩为连续区间, 生成"dst port a or dst portrange b-c"
+func buildPortExpr(ports []uint16) string {
+	if len(ports) == 0 {
+		return ""
+	}
+	sorted := make([]int, 0, len(ports))
+	for _, p := range ports {
+		sorted = append(sorted, int(p))
+	}
+	sort.Ints(sorted)
+	items := make([]string, 0, len(sorted))
+	appendRange := func(left, right int) {
+		if left == right {
+			items = append(items, fmt.Sprintf("dst port %d", left))
+			return
+		}
+		items = append(items, fmt.Sprintf("dst portrange %d-%d", left, right))
+	}
+	left, right := sorted[0], sorted[0]
+	for _, p := range sorted[1:] {
+		if p == right { //重复端口
+			continue
+		}
+		if p == right+1 {
+			right = p
+			continue
+		}
+		appendRange(left, right)
+		left, right = p, p
+	}
+	appendRange(left, right)
+	return strings.Join(items, " or ")
+}
+
+// buildBPFFilter 生成内核侧的过滤表达式: 目标端口在探测范围内的TCP SYN及UDP报文, 且来源不是本机出口ip
+// tcp[tcpflags]仅能作用于ipv4, ipv6的SYN检查仍由handlePacket完成
+func buildBPFFilter(ports []uint16, exitIps []string) string {
+	portExpr := buildPortExpr(ports)
+	if len(portExpr) == 0 {
+		return ""
+	}
+	expr := fmt.Sprintf("((tcp and (%s) and (ip6 or tcp[tcpflags] & tcp-syn != 0)) or (udp and (%s)))", portExpr, portExpr)
+	if len(exitIps) == 0 {
+		return expr
+	}
+	sorted := make([]string, len(exitIps))
+	copy(sorted, exitIps)
+	sort.Strings(sorted)
+	hosts := make([]string, 0, len(sorted))
+	for _, ip := range sorted {
+		hosts = append(hosts, "src host "+ip)
+	}
+	return fmt.Sprintf("%s and not (%s)", expr, strings.Join(hosts, " or "))
+}
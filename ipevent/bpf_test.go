@@ -0,0 +1,24 @@
+package ipevent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildPortExpr(t *testing.T) {
+	assert.Equal(t, "", buildPortExpr(nil))
+	assert.Equal(t, "dst port 22", buildPortExpr([]uint16{22}))
+	assert.Equal(t, "dst port 22 or dst portrange 100-102 or dst port 8080",
+		buildPortExpr([]uint16{8080, 101, 22, 100, 102, 101}))
+}
+
+func TestBuildBPFFilter(t *testing.T) {
+	assert.Equal(t, "", buildBPFFilter(nil, []string{"1.2.3.4"}))
+	assert.Equal(t,
+		"((tcp and (dst port 22) and (ip6 or tcp[tcpflags] & tcp-syn != 0)) or (udp and (dst port 22)))",
+		buildBPFFilter([]uint16{22}, nil))
+	assert.Equal(t,
+		"((tcp and (dst port 22) and (ip6 or tcp[tcpflags] & tcp-syn != 0)) or (udp and (dst port 22))) and not (src host 1.2.3.4 or src host ::1)",
+		buildBPFFilter([]uint16{22}, []string{"::1", "1.2.3.4"}))
+}
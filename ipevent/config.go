@@ -1,9 +1,15 @@
 package ipevent
 
+const (
+	defaultSnapLen = 1600
+)
+
 type config struct {
-	iface   string
+	ifaces  []string
 	exitIps map[string]struct{}
 	portMap map[uint16]struct{}
+	snapLen int32
+	promisc bool
 }
 
 type Option func(c *config)
@@ -17,8 +23,18 @@ func WithEnablePortVisit(ports []uint16) Option {
 }
 
 func WithExitIface(iface string) Option {
+	return WithExitIfaces([]string{iface})
+}
+
+// WithExitIfaces 同时在多个网卡上抓包, 事件统一汇入同一个channel
+func WithExitIfaces(ifaces []string) Option {
 	return func(c *config) {
-		c.iface = iface
+		for _, iface := range ifaces {
+			if len(iface) == 0 {
+				continue
+			}
+			c.ifaces = append(c.ifaces, iface)
+		}
 	}
 }
 
@@ -30,10 +46,28 @@ func WithExitIps(ips []string) Option {
 	}
 }
 
+// WithSnapLen 每个报文最多抓取的字节数, 只需要覆盖到传输层头部即可
+func WithSnapLen(n int32) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.snapLen = n
+		}
+	}
+}
+
+// WithPromisc 是否以混杂模式打开网卡
+func WithPromisc(v bool) Option {
+	return func(c *config) {
+		c.promisc = v
+	}
+}
+
 func applyOpts(opts ...Option) *config {
 	c := &config{
 		exitIps: make(map[string]struct{}),
 		portMap: make(map[uint16]struct{}),
+		snapLen: defaultSnapLen,
+		promisc: true,
 	}
 	for _, opt := range opts {
 		opt(c)
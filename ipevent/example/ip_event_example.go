@@ -11,6 +11,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	defer ev.Close()
 	ch, err := ev.Open(context.Background())
 	if err != nil {
 		panic(err)
@@ -2,8 +2,13 @@ package ipevent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"ip-blackcage/event"
+	"ip-blackcage/metrics"
+	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
@@ -13,41 +18,130 @@ import (
 	"go.uber.org/zap"
 )
 
+var errReaderClosed = errors.New("reader closed")
+
+// IIPEventReader 基于pcap的事件读取器, 支持运行期间更新探测端口
+type IIPEventReader interface {
+	event.IEventReader
+	UpdatePorts(ports []uint16) error
+}
+
 type ipEventReader struct {
 	c       *config
 	ipchain chan event.IEventData
+	mu      sync.RWMutex //保护portMap, 同时保证更新过滤规则与关闭句柄不会并发执行
+	portMap map[uint16]struct{}
+	handles map[string]*pcap.Handle
+	stopped bool //句柄已关闭, 由mu保护
+
+	wg        sync.WaitGroup
+	openOnce  sync.Once
+	closeOnce sync.Once
+	closed    chan struct{}
 }
 
-func NewIPEventReader(opts ...Option) (event.IEventReader, error) {
+func NewIPEventReader(opts ...Option) (IIPEventReader, error) {
 	c := applyOpts(opts...)
-	r := &ipEventReader{c: c, ipchain: make(chan event.IEventData, 1024)}
-	handler, err := pcap.OpenLive(r.c.iface, 1600, true, pcap.BlockForever)
-	if err != nil {
+	if len(c.ifaces) == 0 {
+		return nil, fmt.Errorf("no iface found")
+	}
+	r := &ipEventReader{
+		c:       c,
+		ipchain: make(chan event.IEventData, 1024),
+		portMap: c.portMap,
+		handles: make(map[string]*pcap.Handle, len(c.ifaces)),
+		closed:  make(chan struct{}),
+	}
+	for _, iface := range c.ifaces {
+		if _, ok := r.handles[iface]; ok {
+			continue
+		}
+		handler, err := pcap.OpenLive(iface, r.c.snapLen, r.c.promisc, pcap.BlockForever)
+		if err != nil {
+			r.closeHandles()
+			return nil, fmt.Errorf("open iface:%s failed, err:%w", iface, err)
+		}
+		r.handles[iface] = handler
+	}
+	if err := r.applyFilter(r.portMap); err != nil {
+		r.closeHandles()
 		return nil, err
 	}
-	go r.start(handler)
 	return r, nil
 }
 
-func (r *ipEventReader) start(handler *pcap.Handle) {
-	defer handler.Close()
+func (r *ipEventReader) closeHandles() {
+	for _, handler := range r.handles {
+		handler.Close()
+	}
+}
+
+// applyFilter 为全部句柄设置过滤规则, 运行期间调用时需要持有mu的写锁
+func (r *ipEventReader) applyFilter(portMap map[uint16]struct{}) error {
+	ports := make([]uint16, 0, len(portMap))
+	for p := range portMap {
+		ports = append(ports, p)
+	}
+	exitIps := make([]string, 0, len(r.c.exitIps))
+	for ip := range r.c.exitIps {
+		exitIps = append(exitIps, ip)
+	}
+	expr := buildBPFFilter(ports, exitIps)
+	if len(expr) == 0 { //没有需要探测的端口, 不在内核侧过滤
+		return nil
+	}
+	for iface, handler := range r.handles {
+		if err := handler.SetBPFFilter(expr); err != nil {
+			return fmt.Errorf("set bpf filter failed, iface:%s, expr:%s, err:%w", iface, expr, err)
+		}
+	}
+	logutil.GetLogger(context.Background()).Info("set bpf filter succ", zap.String("expr", expr))
+	return nil
+}
+
+// UpdatePorts 更新探测端口, 并重新生成内核侧的过滤规则, 读取器关闭后返回错误
+func (r *ipEventReader) UpdatePorts(ports []uint16) error {
+	portMap := make(map[uint16]struct{}, len(ports))
+	for _, p := range ports {
+		portMap[p] = struct{}{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return errReaderClosed
+	}
+	if err := r.applyFilter(portMap); err != nil {
+		return err
+	}
+	r.portMap = portMap
+	return nil
+}
+
+func (r *ipEventReader) isWatchPort(port uint16) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.portMap[port]
+	return ok
+}
+
+func (r *ipEventReader) start(iface string, handler *pcap.Handle) {
+	defer r.wg.Done()
 	packetSource := gopacket.NewPacketSource(handler, handler.LinkType())
 	for packet := range packetSource.Packets() {
-		r.handlePacket(packet)
+		metrics.CapturedPackets.Inc()
+		r.handlePacket(iface, packet)
 	}
 }
 
-func (r *ipEventReader) decodeNetInfo(packet gopacket.Packet) (string, string, uint16, uint16, bool) {
+func (r *ipEventReader) decodeNetInfo(iface string, packet gopacket.Packet) (*IPEventData, bool) {
 	var srcip, dstip gopacket.Endpoint
 	var srcport, dstport uint16
+	var protocol string
 	extractFn := func() bool {
 		nl := packet.NetworkLayer()
 		if nl == nil {
 			return false
 		}
-		if nl.LayerType() == layers.LayerTypeIPv6 { // 先不处理ipv6
-			return false
-		}
 		srcip, dstip = nl.NetworkFlow().Endpoints()
 		tpl := packet.TransportLayer()
 		if tpl == nil {
@@ -60,48 +154,92 @@ func (r *ipEventReader) decodeNetInfo(packet gopacket.Packet) (string, string, u
 			}
 			srcport = uint16(ly.SrcPort)
 			dstport = uint16(ly.DstPort)
+			protocol = ProtocolTCP
 			return true
 		}
 		if ly, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
 			srcport = uint16(ly.SrcPort)
 			dstport = uint16(ly.DstPort)
+			protocol = ProtocolUDP
 			return true
 		}
 		return false
 	}
 	if !extractFn() {
-		return "", "", 0, 0, false
+		return nil, false
 	}
-	return srcip.String(), dstip.String(), srcport, dstport, true
+	return &IPEventData{
+		SrcIP:    srcip.String(),
+		DstIP:    dstip.String(),
+		SrcPort:  srcport,
+		DstPort:  dstport,
+		Protocol: protocol,
+		Iface:    iface,
+	}, true
 }
 
-func (r *ipEventReader) handlePacket(packet gopacket.Packet) {
-	srcip, dstip, srcport, dstport, ok := r.decodeNetInfo(packet)
+func (r *ipEventReader) handlePacket(iface string, packet gopacket.Packet) {
+	data, ok := r.decodeNetInfo(iface, packet)
 	if !ok {
 		return
 	}
-	if _, ok := r.c.exitIps[srcip]; ok {
+	if _, ok := r.c.exitIps[data.SrcIP]; ok {
 		return
 	}
-	if _, ok := r.c.portMap[uint16(dstport)]; !ok {
+	if !r.isWatchPort(data.DstPort) {
 		return
 	}
 	logutil.GetLogger(context.Background()).Debug("recv port scan request",
-		zap.String("src", fmt.Sprintf("%s:%d", srcip, srcport)),
-		zap.String("dst", fmt.Sprintf("%s:%d", dstip, dstport)),
+		zap.String("src", net.JoinHostPort(data.SrcIP, strconv.Itoa(int(data.SrcPort)))),
+		zap.String("dst", net.JoinHostPort(data.DstIP, strconv.Itoa(int(data.DstPort)))),
+		zap.String("protocol", data.Protocol),
+		zap.String("iface", data.Iface),
 	)
-	r.ipchain <- event.NewEventData(
+	ev := event.NewEventData(
 		string(event.EventTypePortScan),
 		time.Now().UnixMilli(),
-		&IPEventData{
-			SrcIP:   srcip,
-			DstIP:   dstip,
-			SrcPort: srcport,
-			DstPort: dstport,
-		},
+		data,
 	)
+	select {
+	case r.ipchain <- ev:
+		metrics.EventsEmitted.WithLabelValues(r.Name(), string(event.EventTypePortScan)).Inc()
+	default: //队列已满时丢弃, 避免阻塞抓包
+		metrics.EventsDropped.WithLabelValues(r.Name(), string(event.EventTypePortScan)).Inc()
+	}
+}
+
+func (r *ipEventReader) Name() string {
+	return "pcap"
 }
 
 func (r *ipEventReader) Open(ctx context.Context) (<-chan event.IEventData, error) {
+	r.openOnce.Do(func() {
+		for iface, handler := range r.handles {
+			r.wg.Add(1)
+			go r.start(iface, handler)
+		}
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = r.Close()
+			case <-r.closed:
+			}
+		}()
+	})
 	return r.ipchain, nil
 }
+
+// Close 关闭全部抓包句柄, 等待抓包协程退出后再关闭事件channel
+func (r *ipEventReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.openOnce.Do(func() {}) //未打开时不再允许打开
+		r.mu.Lock()
+		r.stopped = true
+		r.closeHandles()
+		r.mu.Unlock()
+		r.wg.Wait() //抓包协程会读取portMap, 需要在释放锁之后等待
+		close(r.ipchain)
+	})
+	return nil
+}
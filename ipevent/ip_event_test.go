@@ -0,0 +1,24 @@
+package ipevent
+
+import (
+	"ip-blackcage/event"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdatePortsAfterClose(t *testing.T) {
+	r := &ipEventReader{
+		c:       applyOpts(),
+		ipchain: make(chan event.IEventData, 1),
+		portMap: make(map[uint16]struct{}),
+		handles: make(map[string]*pcap.Handle),
+		closed:  make(chan struct{}),
+	}
+	assert.NoError(t, r.UpdatePorts([]uint16{22}))
+	assert.True(t, r.isWatchPort(22))
+	assert.NoError(t, r.Close())
+	assert.ErrorIs(t, r.UpdatePorts([]uint16{80}), errReaderClosed)
+	assert.False(t, r.isWatchPort(80))
+}
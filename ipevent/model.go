@@ -1,8 +1,15 @@
 package ipevent
 
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
 type IPEventData struct {
-	SrcIP   string
-	DstIP   string
-	SrcPort uint16
-	DstPort uint16
+	SrcIP    string
+	DstIP    string
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol string
+	Iface    string //报文进入的网卡
 }
@@ -0,0 +1,167 @@
+package ipmatch
+
+import (
+	"ip-blackcage/utils"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Hit 命中的条目及其来源
+type Hit struct {
+	Entry   string
+	Sources []string
+}
+
+type IMatcher interface {
+	// Add 添加ip或者cidr, 同一个条目可以来自多个来源
+	Add(entry string, source string) error
+	// Remove 移除来源下的条目, 全部来源都移除后条目才会失效
+	Remove(entry string, source string) error
+	// Match 返回与ip(或者cidr)存在交集的最长前缀条目
+	Match(ip string) (*Hit, bool)
+	// Reset 清空来源下的全部条目
+	Reset(source string)
+}
+
+type node struct {
+	children [2]*node
+	entry    string
+	sources  map[string]struct{}
+}
+
+func (n *node) active() bool {
+	return len(n.sources) > 0
+}
+
+// defaultMatcher 按位展开的前缀树, ipv4/ipv6各一棵, 查询耗时只与地址长度相关
+type defaultMatcher struct {
+	mu sync.RWMutex
+	v4 *node
+	v6 *node
+}
+
+func NewMatcher() IMatcher {
+	return &defaultMatcher{v4: &node{}, v6: &node{}}
+}
+
+func (m *defaultMatcher) rootOf(ipnet *net.IPNet) (*node, net.IP, int) {
+	ones, _ := ipnet.Mask.Size()
+	if v4 := ipnet.IP.To4(); v4 != nil {
+		return m.v4, v4, ones
+	}
+	return m.v6, ipnet.IP.To16(), ones
+}
+
+func bitAt(ip net.IP, idx int) int {
+	return int(ip[idx/8]>>(7-uint(idx%8))) & 1
+}
+
+func (m *defaultMatcher) Add(entry string, source string) error {
+	ipnet, err := utils.ParseIPNet(entry)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ip, ones := m.rootOf(ipnet)
+	for i := 0; i < ones; i++ {
+		b := bitAt(ip, i)
+		if n.children[b] == nil {
+			n.children[b] = &node{}
+		}
+		n = n.children[b]
+	}
+	if n.sources == nil {
+		n.sources = make(map[string]struct{}, 1)
+	}
+	n.entry = ipnet.String()
+	n.sources[source] = struct{}{}
+	return nil
+}
+
+func (m *defaultMatcher) Remove(entry string, source string) error {
+	ipnet, err := utils.ParseIPNet(entry)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ip, ones := m.rootOf(ipnet)
+	for i := 0; i < ones && n != nil; i++ {
+		n = n.children[bitAt(ip, i)]
+	}
+	if n == nil {
+		return nil
+	}
+	delete(n.sources, source)
+	return nil
+}
+
+func (m *defaultMatcher) Match(ip string) (*Hit, bool) {
+	ipnet, err := utils.ParseIPNet(ip)
+	if err != nil {
+		return nil, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, addr, ones := m.rootOf(ipnet)
+	var found *node
+	for i := 0; ; i++ {
+		if n.active() {
+			found = n
+		}
+		if i == ones {
+			break
+		}
+		n = n.children[bitAt(addr, i)]
+		if n == nil {
+			break
+		}
+	}
+	if found == nil && n != nil { //查询的是cidr时, 被其包含的条目同样视为命中
+		found = firstActive(n)
+	}
+	if found == nil {
+		return nil, false
+	}
+	return toHit(found), true
+}
+
+func firstActive(n *node) *node {
+	if n == nil {
+		return nil
+	}
+	if n.active() {
+		return n
+	}
+	if rs := firstActive(n.children[0]); rs != nil {
+		return rs
+	}
+	return firstActive(n.children[1])
+}
+
+func toHit(n *node) *Hit {
+	rs := &Hit{Entry: n.entry, Sources: make([]string, 0, len(n.sources))}
+	for src := range n.sources {
+		rs.Sources = append(rs.Sources, src)
+	}
+	sort.Strings(rs.Sources)
+	return rs
+}
+
+func (m *defaultMatcher) Reset(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resetSource(m.v4, source)
+	resetSource(m.v6, source)
+}
+
+func resetSource(n *node, source string) {
+	if n == nil {
+		return
+	}
+	delete(n.sources, source)
+	resetSource(n.children[0], source)
+	resetSource(n.children[1], source)
+}
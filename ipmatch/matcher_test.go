@@ -0,0 +1,53 @@
+package ipmatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	m := NewMatcher()
+	assert.NoError(t, m.Add("10.0.0.0/8", "local"))
+	assert.NoError(t, m.Add("10.1.0.0/16", "user"))
+	assert.NoError(t, m.Add("1.2.3.4", "exit"))
+	assert.NoError(t, m.Add("fe80::/10", "local"))
+	assert.Error(t, m.Add("1.2.3", "user"))
+
+	hit, ok := m.Match("10.1.2.3")
+	assert.True(t, ok)
+	assert.Equal(t, "10.1.0.0/16", hit.Entry) //最长前缀
+	assert.Equal(t, []string{"user"}, hit.Sources)
+	hit, ok = m.Match("10.2.2.3")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.0/8", hit.Entry)
+	hit, ok = m.Match("1.2.3.4")
+	assert.True(t, ok)
+	assert.Equal(t, "1.2.3.4/32", hit.Entry)
+	_, ok = m.Match("1.2.3.5")
+	assert.False(t, ok)
+	_, ok = m.Match("fe80::1")
+	assert.True(t, ok)
+	_, ok = m.Match("2001:db8::1")
+	assert.False(t, ok)
+	//cidr包含白名单条目时同样命中
+	hit, ok = m.Match("1.2.3.0/24")
+	assert.True(t, ok)
+	assert.Equal(t, "1.2.3.4/32", hit.Entry)
+	_, ok = m.Match("1.2.4.0/24")
+	assert.False(t, ok)
+}
+
+func TestRemoveAndReset(t *testing.T) {
+	m := NewMatcher()
+	assert.NoError(t, m.Add("1.2.3.0/24", "user"))
+	assert.NoError(t, m.Add("1.2.3.0/24", "temp"))
+	assert.NoError(t, m.Remove("1.2.3.0/24", "user"))
+	hit, ok := m.Match("1.2.3.4")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"temp"}, hit.Sources)
+	assert.NoError(t, m.Remove("5.6.7.8", "user")) //不存在的条目
+	m.Reset("temp")
+	_, ok = m.Match("1.2.3.4")
+	assert.False(t, ok)
+}
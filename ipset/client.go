@@ -0,0 +1,59 @@
+package ipset
+
+import (
+	"context"
+	"fmt"
+	"ip-blackcage/metrics"
+	"time"
+
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+const (
+	DriverAuto    = "auto"    //优先使用netlink, 失败时回退到ipset命令
+	DriverNetlink = "netlink" //通过netlink直接与内核交互
+	DriverExec    = "exec"    //调用ipset命令
+)
+
+// IIPSet ipset操作集合, 命令行与netlink两种实现提供相同的方法
+type IIPSet interface {
+	Create(ctx context.Context, set string, typ SetType, opts ...CmdOption) error
+	Destroy(ctx context.Context, set string, opts ...CmdOption) error
+	Add(ctx context.Context, set string, data string, opts ...CmdOption) error
+	Del(ctx context.Context, set string, data string, opts ...CmdOption) error
+	Test(ctx context.Context, set string, data string, opts ...CmdOption) (bool, error)
+	List(ctx context.Context, set string, opts ...CmdOption) (*Header, []string, error)
+	Restore(ctx context.Context, set string, ips []string, opts ...CmdOption) error
+	RestoreEntries(ctx context.Context, set string, entries []Entry, opts ...CmdOption) error
+	Rename(ctx context.Context, olds, news string, opts ...CmdOption) error
+	Swap(ctx context.Context, olds, news string, opts ...CmdOption) error
+	Flush(ctx context.Context, set string, opts ...CmdOption) error
+	Version(ctx context.Context, opts ...CmdOption) (string, string, error)
+}
+
+// NewClient 按driver创建ipset客户端
+func NewClient(ctx context.Context, driver string) (IIPSet, error) {
+	switch driver {
+	case DriverNetlink:
+		return NewNetlink()
+	case DriverExec:
+		return New()
+	case DriverAuto, "":
+		set, err := NewNetlink()
+		if err == nil {
+			return set, nil
+		}
+		logutil.GetLogger(ctx).Warn("init netlink ipset failed, fallback to ipset command", zap.Error(err))
+		return New()
+	default:
+		return nil, fmt.Errorf("unsupported ipset driver:%s", driver)
+	}
+}
+
+func observeCmd(cmd string, start time.Time, err error) {
+	metrics.IPSetCmdDuration.WithLabelValues(cmd).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.IPSetCmdFailures.WithLabelValues(cmd).Inc()
+	}
+}
@@ -4,6 +4,12 @@ import "strconv"
 
 type config struct {
 	params []string
+	//以下字段供netlink实现使用, 命令行实现只关心params
+	exist      bool
+	terse      bool
+	timeout    *uint64
+	maxElement uint64
+	family     Family
 }
 
 func (c *config) addParam(ps ...string) {
@@ -15,6 +21,7 @@ type CmdOption func(c *config)
 func WithExist() CmdOption {
 	return func(c *config) {
 		c.addParam("-exist")
+		c.exist = true
 	}
 }
 
@@ -52,6 +59,7 @@ func WithName() CmdOption {
 func WithTerse() CmdOption {
 	return func(c *config) {
 		c.addParam("-terse")
+		c.terse = true
 	}
 }
 
@@ -64,6 +72,23 @@ func WithFile(fname string) CmdOption {
 func WithMaxElement(sz uint64) CmdOption {
 	return func(c *config) {
 		c.addParam("maxelem", strconv.FormatUint(sz, 10))
+		c.maxElement = sz
+	}
+}
+
+// timeout 单位为秒, 创建集合时表示默认超时, 添加元素时表示该元素的超时, 0表示永不过期
+func WithTimeout(sec uint64) CmdOption {
+	return func(c *config) {
+		c.addParam("timeout", strconv.FormatUint(sec, 10))
+		c.timeout = &sec
+	}
+}
+
+// family { inet | inet6 }
+func WithFamily(f Family) CmdOption {
+	return func(c *config) {
+		c.addParam("family", string(f))
+		c.family = f
 	}
 }
 
@@ -2,9 +2,11 @@ package ipset
 
 type SetType string
 type OutputType string
+type Family string
 
 const (
-	SetTypeHashNet SetType = "hash:net"
+	SetTypeHashNet     SetType = "hash:net"
+	SetTypeHashNetPort SetType = "hash:net,port" //元素格式为 ip[/cidr],proto:port
 )
 
 const (
@@ -12,3 +14,11 @@ const (
 	OutputTypeSave  OutputType = "save"
 	OutputTypeXml   OutputType = "xml"
 )
+
+const (
+	FamilyInet  Family = "inet"
+	FamilyInet6 Family = "inet6"
+)
+
+// MaxTimeout 内核允许的最大超时时间(秒), 超过该值的元素按该值写入, 由对账流程在到期前按剩余时长续期
+const MaxTimeout uint64 = 2147483
@@ -9,6 +9,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -55,7 +56,11 @@ func (s *IPSet) runCmd(ctx context.Context, c *config, args ...string) *errPack
 	var stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
+	start := time.Now()
 	err := cmd.Run()
+	if len(args) > 0 {
+		observeCmd(args[0], start, err)
+	}
 	info := &errPack{
 		err:    err,
 		stdout: stdout.Bytes(),
@@ -93,8 +98,9 @@ func (s *IPSet) ListRaw(ctx context.Context, set string, opts ...CmdOption) ([]b
 	return pack.stdout, nil
 }
 
-func (s *IPSet) List(ctx context.Context, set string) (*Header, []string, error) {
-	raw, err := s.ListRaw(ctx, set, WithOutput("xml"))
+// List 读取集合的头部信息及元素, 传入WithTerse时仅读取头部信息
+func (s *IPSet) List(ctx context.Context, set string, opts ...CmdOption) (*Header, []string, error) {
+	raw, err := s.ListRaw(ctx, set, append([]CmdOption{WithOutput("xml")}, opts...)...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -115,9 +121,21 @@ func (s *IPSet) List(ctx context.Context, set string) (*Header, []string, error)
 }
 
 func (s *IPSet) Restore(ctx context.Context, set string, ips []string, opts ...CmdOption) error {
-	buf := bytes.Buffer{}
+	entries := make([]Entry, 0, len(ips))
 	for _, ip := range ips {
-		buf.WriteString(fmt.Sprintf("add %s %s -exist\n", set, ip))
+		entries = append(entries, Entry{Data: ip})
+	}
+	return s.RestoreEntries(ctx, set, entries, opts...)
+}
+
+func (s *IPSet) RestoreEntries(ctx context.Context, set string, entries []Entry, opts ...CmdOption) error {
+	buf := bytes.Buffer{}
+	for _, ent := range entries {
+		if ent.Timeout > 0 {
+			buf.WriteString(fmt.Sprintf("add %s %s timeout %d -exist\n", set, ent.Data, ent.Timeout))
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("add %s %s -exist\n", set, ent.Data))
 	}
 	tmpDir := os.TempDir()
 	tmpName := "tmp-ips-" + uuid.NewString()
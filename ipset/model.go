@@ -17,12 +17,13 @@ type Ipset struct {
 }
 
 type Header struct {
-	Family     string `xml:"family"`
-	Hashsize   int    `xml:"hashsize"`
-	Maxelem    int    `xml:"maxelem"`
-	Memsize    int    `xml:"memsize"`
-	References int    `xml:"references"`
-	Numentries int    `xml:"numentries"`
+	Family     string  `xml:"family"`
+	Hashsize   int     `xml:"hashsize"`
+	Maxelem    int     `xml:"maxelem"`
+	Memsize    int     `xml:"memsize"`
+	References int     `xml:"references"`
+	Numentries int     `xml:"numentries"`
+	Timeout    *uint64 `xml:"timeout"` //集合的默认超时(秒), 集合不支持超时时为nil
 }
 
 type Members struct {
@@ -30,5 +31,12 @@ type Members struct {
 }
 
 type Member struct {
-	Elem string `xml:"elem"`
+	Elem    string `xml:"elem"`
+	Timeout uint64 `xml:"timeout"`
+}
+
+// Entry 通过restore批量写入的元素, Timeout为0时使用集合的默认超时
+type Entry struct {
+	Data    string
+	Timeout uint64
 }
@@ -0,0 +1,376 @@
+package ipset
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// defaultRestoreBatchSize 批量写入时单个请求携带的元素数, 嵌套属性的长度不能超过65535字节
+const defaultRestoreBatchSize = 256
+
+// netlinkIPSet 通过NFNL_SUBSYS_IPSET直接与内核交互, 避免每次操作都fork ipset进程
+type netlinkIPSet struct {
+	h *netlink.Handle
+	//netlink库未提供的请求(rename, 批量写入)通过该socket发送, 与h在同一命名空间中创建, 不依赖调用时所在线程的命名空间
+	sock *nl.SocketHandle
+}
+
+func NewNetlink() (IIPSet, error) {
+	h, err := netlink.NewHandle(unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("open netlink handle failed, err:%w", err)
+	}
+	sock, err := nl.GetNetlinkSocketAt(netns.None(), netns.None(), unix.NETLINK_NETFILTER)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("open netlink socket failed, err:%w", err)
+	}
+	s := &netlinkIPSet{h: h, sock: &nl.SocketHandle{Socket: sock}}
+	//探测内核是否支持ipset
+	if _, _, err := s.Version(context.Background()); err != nil {
+		h.Close()
+		s.sock.Close()
+		return nil, fmt.Errorf("probe ipset protocol failed, err:%w", err)
+	}
+	return s, nil
+}
+
+// newRequest 构造ipset请求, 与netlink库中Handle的请求格式一致
+func (s *netlinkIPSet) newRequest(cmd int, set string) *nl.NetlinkRequest {
+	req := &nl.NetlinkRequest{
+		NlMsghdr: unix.NlMsghdr{
+			Len:   uint32(unix.SizeofNlMsghdr),
+			Type:  uint16(cmd | (unix.NFNL_SUBSYS_IPSET << 8)),
+			Flags: uint16(nl.GetIpsetFlags(cmd)),
+		},
+		Sockets: map[int]*nl.SocketHandle{unix.NETLINK_NETFILTER: s.sock},
+	}
+	req.AddData(&nl.Nfgenmsg{NfgenFamily: uint8(unix.AF_NETLINK), Version: nl.NFNETLINK_V0})
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_PROTOCOL, nl.Uint8Attr(nl.IPSET_PROTOCOL)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME, nl.ZeroTerminated(set)))
+	return req
+}
+
+func execute(req *nl.NetlinkRequest) error {
+	_, err := req.Execute(unix.NETLINK_NETFILTER, 0)
+	var errno syscall.Errno
+	if errors.As(err, &errno) && int(errno) >= nl.IPSET_ERR_PRIVATE {
+		return nl.IPSetError(uintptr(errno))
+	}
+	return err
+}
+
+// encodeEntry 编码单个元素, 与netlink库IpsetAdd的编码一致, 仅包含本项目用到的字段
+func encodeEntry(ent *netlink.IPSetEntry, lineno uint32) *nl.RtAttr {
+	data := nl.NewRtAttr(nl.IPSET_ATTR_DATA|int(nl.NLA_F_NESTED), nil)
+	if ent.Timeout != nil {
+		data.AddChild(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_TIMEOUT | nl.NLA_F_NET_BYTEORDER, Value: *ent.Timeout})
+	}
+	typ, ip := int(nl.NLA_F_NET_BYTEORDER)|nl.IPSET_ATTR_IPADDR_IPV6, ent.IP
+	if v4 := ent.IP.To4(); v4 != nil {
+		typ, ip = int(nl.NLA_F_NET_BYTEORDER)|nl.IPSET_ATTR_IPADDR_IPV4, v4
+	}
+	data.AddChild(nl.NewRtAttr(nl.IPSET_ATTR_IP|int(nl.NLA_F_NESTED), nl.NewRtAttr(typ, ip).Serialize()))
+	if ent.CIDR != 0 {
+		data.AddChild(nl.NewRtAttr(nl.IPSET_ATTR_CIDR, nl.Uint8Attr(ent.CIDR)))
+	}
+	if ent.Port != nil {
+		proto := uint8(unix.IPPROTO_TCP)
+		if ent.Protocol != nil {
+			proto = *ent.Protocol
+		}
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, *ent.Port)
+		data.AddChild(nl.NewRtAttr(nl.IPSET_ATTR_PROTO, nl.Uint8Attr(proto)))
+		data.AddChild(nl.NewRtAttr(int(nl.IPSET_ATTR_PORT|nl.NLA_F_NET_BYTEORDER), port))
+	}
+	data.AddChild(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_LINENO | nl.NLA_F_NET_BYTEORDER, Value: lineno})
+	return data
+}
+
+// call 统一处理监控上报, 同时兜底netlink库在非errno错误下的panic
+func (s *netlinkIPSet) call(cmd string, fn func() error) (err error) {
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("netlink ipset %s panic:%v", cmd, r)
+		}
+		observeCmd(cmd, start, err)
+	}()
+	return fn()
+}
+
+func toNetlinkFamily(f Family) uint8 {
+	if f == FamilyInet6 {
+		return unix.AF_INET6
+	}
+	return unix.AF_INET
+}
+
+func fromNetlinkFamily(f uint8) string {
+	if f == unix.AF_INET6 {
+		return string(FamilyInet6)
+	}
+	return string(FamilyInet)
+}
+
+func toTimeout(c *config) *uint32 {
+	if c.timeout == nil {
+		return nil
+	}
+	v := uint32(*c.timeout)
+	return &v
+}
+
+// parseEntry 将ip或cidr(hash:net,port类型时附带,proto:port)转换为netlink的元素结构
+func parseEntry(data string) (*netlink.IPSetEntry, error) {
+	addr, port, hasPort := strings.Cut(data, ",")
+	ent, err := parseNetEntry(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !hasPort {
+		return ent, nil
+	}
+	if err := parsePortEntry(ent, port); err != nil {
+		return nil, fmt.Errorf("invalid entry:%s, err:%w", data, err)
+	}
+	return ent, nil
+}
+
+func parseNetEntry(data string) (*netlink.IPSetEntry, error) {
+	if !strings.Contains(data, "/") {
+		ip := net.ParseIP(data)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip:%s", data)
+		}
+		return &netlink.IPSetEntry{IP: ip}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr:%s, err:%w", data, err)
+	}
+	ones, _ := ipnet.Mask.Size()
+	return &netlink.IPSetEntry{IP: ipnet.IP, CIDR: uint8(ones)}, nil
+}
+
+func parsePortEntry(ent *netlink.IPSetEntry, data string) error {
+	proto, portstr, ok := strings.Cut(data, ":")
+	if !ok { //未指定协议时与ipset命令一致, 默认为tcp
+		proto, portstr = "tcp", data
+	}
+	var protoNum uint8
+	switch proto {
+	case "tcp":
+		protoNum = unix.IPPROTO_TCP
+	case "udp":
+		protoNum = unix.IPPROTO_UDP
+	default:
+		return fmt.Errorf("unsupported protocol:%s", proto)
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port:%s, err:%w", portstr, err)
+	}
+	p := uint16(port)
+	ent.Protocol = &protoNum
+	ent.Port = &p
+	return nil
+}
+
+func formatEntry(ent *netlink.IPSetEntry) string {
+	bits := 32
+	if ent.IP.To4() == nil {
+		bits = 128
+	}
+	rs := ent.IP.String()
+	if ent.CIDR != 0 && int(ent.CIDR) != bits {
+		rs += "/" + strconv.Itoa(int(ent.CIDR))
+	}
+	if ent.Port == nil {
+		return rs
+	}
+	proto := "tcp"
+	if ent.Protocol != nil && *ent.Protocol == unix.IPPROTO_UDP {
+		proto = "udp"
+	}
+	return rs + "," + proto + ":" + strconv.Itoa(int(*ent.Port))
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, syscall.ENOENT)
+}
+
+func (s *netlinkIPSet) Create(_ context.Context, set string, typ SetType, opts ...CmdOption) error {
+	c := applyOpts(opts...)
+	return s.call("create", func() error {
+		return s.h.IpsetCreate(set, string(typ), netlink.IpsetCreateOptions{
+			Replace:     c.exist,
+			Timeout:     toTimeout(c),
+			Family:      toNetlinkFamily(c.family),
+			MaxElements: uint32(c.maxElement),
+		})
+	})
+}
+
+func (s *netlinkIPSet) Destroy(_ context.Context, set string, opts ...CmdOption) error {
+	c := applyOpts(opts...)
+	return s.call("destroy", func() error {
+		err := s.h.IpsetDestroy(set)
+		if c.exist && isNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *netlinkIPSet) addDel(cmd string, set string, data string, c *config) error {
+	ent, err := parseEntry(data)
+	if err != nil {
+		return err
+	}
+	ent.Replace = c.exist //不带NLM_F_EXCL时, 内核对重复添加/删除不存在的元素不报错
+	ent.Timeout = toTimeout(c)
+	return s.call(cmd, func() error {
+		if cmd == "add" {
+			return s.h.IpsetAdd(set, ent)
+		}
+		return s.h.IpsetDel(set, ent)
+	})
+}
+
+func (s *netlinkIPSet) Add(_ context.Context, set string, data string, opts ...CmdOption) error {
+	return s.addDel("add", set, data, applyOpts(opts...))
+}
+
+func (s *netlinkIPSet) Del(_ context.Context, set string, data string, opts ...CmdOption) error {
+	return s.addDel("del", set, data, applyOpts(opts...))
+}
+
+func (s *netlinkIPSet) Test(_ context.Context, set string, data string, _ ...CmdOption) (bool, error) {
+	ent, err := parseEntry(data)
+	if err != nil {
+		return false, err
+	}
+	var ok bool
+	err = s.call("test", func() error {
+		var err error
+		ok, err = s.h.IpsetTest(set, ent)
+		return err
+	})
+	return ok, err
+}
+
+func (s *netlinkIPSet) List(_ context.Context, set string, opts ...CmdOption) (*Header, []string, error) {
+	c := applyOpts(opts...)
+	var rs *netlink.IPSetResult
+	err := s.call("list", func() error {
+		var err error
+		rs, err = s.h.IpsetList(set)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	header := &Header{
+		Family:     fromNetlinkFamily(rs.Family),
+		Hashsize:   int(rs.HashSize),
+		Maxelem:    int(rs.MaxElements),
+		Memsize:    int(rs.SizeInMemory),
+		References: int(rs.References),
+		Numentries: int(rs.NumEntries),
+	}
+	if rs.Timeout != nil {
+		timeout := uint64(*rs.Timeout)
+		header.Timeout = &timeout
+	}
+	if c.terse {
+		return header, nil, nil
+	}
+	ips := make([]string, 0, len(rs.Entries))
+	for i := range rs.Entries {
+		ips = append(ips, formatEntry(&rs.Entries[i]))
+	}
+	return header, ips, nil
+}
+
+func (s *netlinkIPSet) Restore(ctx context.Context, set string, ips []string, opts ...CmdOption) error {
+	entries := make([]Entry, 0, len(ips))
+	for _, ip := range ips {
+		entries = append(entries, Entry{Data: ip})
+	}
+	return s.RestoreEntries(ctx, set, entries, opts...)
+}
+
+// RestoreEntries 语义与restore文件中的"add ... -exist"一致, 元素按批放入IPSET_ATTR_ADT中写入, 每批只需一次netlink往返
+func (s *netlinkIPSet) RestoreEntries(_ context.Context, set string, entries []Entry, _ ...CmdOption) error {
+	for start := 0; start < len(entries); start += defaultRestoreBatchSize {
+		end := min(start+defaultRestoreBatchSize, len(entries))
+		req := s.newRequest(nl.IPSET_CMD_ADD, set) //不带NLM_F_EXCL, 已存在的元素直接覆盖
+		//内核要求携带IPSET_ATTR_ADT的请求同时携带IPSET_ATTR_LINENO
+		req.AddData(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_LINENO | nl.NLA_F_NET_BYTEORDER, Value: 0})
+		adt := nl.NewRtAttr(nl.IPSET_ATTR_ADT|int(nl.NLA_F_NESTED), nil)
+		for i := start; i < end; i++ {
+			ent, err := parseEntry(entries[i].Data)
+			if err != nil {
+				return fmt.Errorf("restore entry:%s failed, err:%w", entries[i].Data, err)
+			}
+			if entries[i].Timeout > 0 {
+				timeout := uint32(entries[i].Timeout)
+				ent.Timeout = &timeout
+			}
+			adt.AddChild(encodeEntry(ent, uint32(i+1)))
+		}
+		req.AddData(adt)
+		if err := s.call("restore", func() error { return execute(req) }); err != nil {
+			return fmt.Errorf("restore entries:[%s, %s] failed, err:%w", entries[start].Data, entries[end-1].Data, err)
+		}
+	}
+	return nil
+}
+
+// Rename netlink库未提供rename, 手动构造请求并通过客户端的socket发送
+func (s *netlinkIPSet) Rename(_ context.Context, olds, news string, _ ...CmdOption) error {
+	return s.call("rename", func() error {
+		req := s.newRequest(nl.IPSET_CMD_RENAME, olds)
+		req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME2, nl.ZeroTerminated(news)))
+		return execute(req)
+	})
+}
+
+func (s *netlinkIPSet) Swap(_ context.Context, olds, news string, _ ...CmdOption) error {
+	return s.call("swap", func() error {
+		return s.h.IpsetSwap(olds, news)
+	})
+}
+
+func (s *netlinkIPSet) Flush(_ context.Context, set string, _ ...CmdOption) error {
+	return s.call("flush", func() error {
+		return s.h.IpsetFlush(set)
+	})
+}
+
+func (s *netlinkIPSet) Version(_ context.Context, _ ...CmdOption) (string, string, error) {
+	var proto, minVer uint8
+	err := s.call("version", func() error {
+		var err error
+		proto, minVer, err = s.h.IpsetProtocol()
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return "netlink", fmt.Sprintf("%d (min %d)", proto, minVer), nil
+}
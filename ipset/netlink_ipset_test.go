@@ -0,0 +1,93 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseAndFormatEntry(t *testing.T) {
+	for _, item := range []string{"1.2.3.4", "10.0.0.0/8", "2001:db8::1", "fe80::/10", "1.2.3.4,tcp:22", "fe80::/10,udp:53"} {
+		ent, err := parseEntry(item)
+		assert.NoError(t, err)
+		assert.Equal(t, item, formatEntry(ent))
+	}
+	ent, err := parseEntry("1.2.3.4/32")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", formatEntry(ent))
+	_, err = parseEntry("1.2.3")
+	assert.Error(t, err)
+	_, err = parseEntry("1.2.3.4/33")
+	assert.Error(t, err)
+	ent, err = parseEntry("1.2.3.4,3389")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4,tcp:3389", formatEntry(ent))
+	_, err = parseEntry("1.2.3.4,icmp:1")
+	assert.Error(t, err)
+	_, err = parseEntry("1.2.3.4,tcp:65536")
+	assert.Error(t, err)
+}
+
+// runInNetNS 在独立的网络命名空间中执行, 无权限或内核不支持ipset时跳过
+func runInNetNS(t *testing.T, fn func() error) {
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		runtime.LockOSThread() //不解锁, goroutine退出时线程随之销毁
+		if err = unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			err = fmt.Errorf("create net namespace failed, err:%w", err)
+			return
+		}
+		err = fn()
+	}()
+	<-done
+	if err == nil {
+		return
+	}
+	for _, errno := range []unix.Errno{unix.EPERM, unix.EACCES, unix.EPROTONOSUPPORT, unix.EAFNOSUPPORT, unix.EOPNOTSUPP} {
+		if errors.Is(err, errno) {
+			t.Skipf("environment not supported, err:%v", err)
+		}
+	}
+	t.Fatal(err)
+}
+
+func TestNetlinkRestoreAndRename(t *testing.T) {
+	runInNetNS(t, func() error {
+		ctx := context.Background()
+		s, err := NewNetlink()
+		if err != nil {
+			return err
+		}
+		if err := s.Create(ctx, "test-set", SetTypeHashNetPort, WithFamily(FamilyInet), WithTimeout(0), WithMaxElement(1024)); err != nil {
+			return err
+		}
+		entries := make([]Entry, 0, 2*defaultRestoreBatchSize+2)
+		for i := 0; i < 2*defaultRestoreBatchSize+1; i++ { //跨越多个批次
+			entries = append(entries, Entry{Data: fmt.Sprintf("10.0.%d.%d,udp:%d", i/256, i%256, i+1), Timeout: uint64(i % 2 * 3600)})
+		}
+		entries = append(entries, Entry{Data: "10.1.0.0/16,tcp:22"})
+		assert.NoError(t, s.RestoreEntries(ctx, "test-set", entries))
+		assert.NoError(t, s.RestoreEntries(ctx, "test-set", entries[:3])) //重复写入不报错
+		header, items, err := s.List(ctx, "test-set")
+		assert.NoError(t, err)
+		assert.Equal(t, len(entries), header.Numentries)
+		assert.Contains(t, items, "10.1.0.0/16,tcp:22")
+		assert.Contains(t, items, "10.0.2.0,udp:513")
+
+		assert.NoError(t, s.Rename(ctx, "test-set", "test-set2"))
+		_, _, err = s.List(ctx, "test-set")
+		assert.Error(t, err)
+		header, _, err = s.List(ctx, "test-set2")
+		assert.NoError(t, err)
+		assert.Equal(t, len(entries), header.Numentries)
+		assert.Error(t, s.RestoreEntries(ctx, "test-set", entries[:1])) //集合不存在
+		return s.Destroy(ctx, "test-set2")
+	})
+}
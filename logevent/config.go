@@ -0,0 +1,39 @@
+package logevent
+
+import "time"
+
+const (
+	defaultPollInterval = 1 * time.Second
+)
+
+type config struct {
+	rules        []*Rule
+	pollInterval time.Duration
+}
+
+type Option func(c *config)
+
+func WithRule(rs ...*Rule) Option {
+	return func(c *config) {
+		c.rules = append(c.rules, rs...)
+	}
+}
+
+// WithPollInterval 检查文件新内容及轮转的间隔
+func WithPollInterval(d time.Duration) Option {
+	return func(c *config) {
+		if d > 0 {
+			c.pollInterval = d
+		}
+	}
+}
+
+func applyOpts(opts ...Option) *config {
+	c := &config{
+		pollInterval: defaultPollInterval,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
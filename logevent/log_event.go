@@ -0,0 +1,184 @@
+package logevent
+
+import (
+	"context"
+	"fmt"
+	"ip-blackcage/event"
+	"ip-blackcage/metrics"
+	"ip-blackcage/rule"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+type matcher struct {
+	name   string
+	exps   []*regexp.Regexp
+	engine rule.IRuleEngine //为nil时每次命中都产生事件
+}
+
+func newMatcher(r *Rule) (*matcher, error) {
+	if err := applyPreset(r); err != nil {
+		return nil, err
+	}
+	if len(r.Name) == 0 {
+		return nil, fmt.Errorf("no rule name found")
+	}
+	if len(r.Files) == 0 || len(r.Patterns) == 0 {
+		return nil, fmt.Errorf("rule:%s has no file or pattern", r.Name)
+	}
+	m := &matcher{name: r.Name}
+	for _, p := range r.Patterns {
+		exp, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("compile pattern of rule:%s failed, pattern:%s, err:%w", r.Name, p, err)
+		}
+		if exp.SubexpIndex("ip") < 0 {
+			return nil, fmt.Errorf("pattern of rule:%s has no named group ip, pattern:%s", r.Name, p)
+		}
+		m.exps = append(m.exps, exp)
+	}
+	if r.Threshold > 1 {
+		engine, err := rule.NewEngine(rule.WithRule(&rule.Rule{
+			Name:       r.Name,
+			Threshold:  r.Threshold,
+			Window:     r.Window,
+			EventTypes: []string{string(event.EventTypeLogMatch)},
+		}))
+		if err != nil {
+			return nil, err
+		}
+		m.engine = engine
+	}
+	return m, nil
+}
+
+// match 返回行中匹配到的合法ip
+func (m *matcher) match(line string) (string, bool) {
+	for _, exp := range m.exps {
+		sub := exp.FindStringSubmatch(line)
+		if sub == nil {
+			continue
+		}
+		ip := net.ParseIP(sub[exp.SubexpIndex("ip")])
+		if ip == nil {
+			continue
+		}
+		return ip.String(), true
+	}
+	return "", false
+}
+
+// check 记录一次命中, 达到阈值时返回true
+func (m *matcher) check(ip string, ts int64) bool {
+	if m.engine == nil {
+		return true
+	}
+	_, ok := m.engine.Check(ip, string(event.EventTypeLogMatch), "", "", 0, ts)
+	return ok
+}
+
+type logEventReader struct {
+	c        *config
+	ipchain  chan event.IEventData
+	matchers map[string][]*matcher //文件 => 作用在该文件上的规则
+
+	wg        sync.WaitGroup
+	openOnce  sync.Once
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewLogEventReader 跟踪日志文件, 行内容匹配规则时产生log_match事件
+func NewLogEventReader(opts ...Option) (event.IEventReader, error) {
+	c := applyOpts(opts...)
+	if len(c.rules) == 0 {
+		return nil, fmt.Errorf("no rule found")
+	}
+	r := &logEventReader{
+		c:        c,
+		ipchain:  make(chan event.IEventData, 1024),
+		matchers: make(map[string][]*matcher),
+		closed:   make(chan struct{}),
+	}
+	for _, item := range c.rules {
+		m, err := newMatcher(item)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range item.Files {
+			r.matchers[f] = append(r.matchers[f], m)
+		}
+	}
+	return r, nil
+}
+
+func (r *logEventReader) Open(ctx context.Context) (<-chan event.IEventData, error) {
+	r.openOnce.Do(func() {
+		tctx, cancel := context.WithCancel(ctx)
+		for file, ms := range r.matchers {
+			file, ms := file, ms
+			r.wg.Add(1)
+			go func() {
+				defer r.wg.Done()
+				newTailer(file).run(tctx, r.c.pollInterval, func(line string) {
+					r.handleLine(tctx, file, ms, line)
+				})
+			}()
+		}
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = r.Close()
+			case <-r.closed:
+			}
+			cancel()
+		}()
+	})
+	return r.ipchain, nil
+}
+
+func (r *logEventReader) Name() string {
+	return "log"
+}
+
+// Close 停止跟踪全部文件, 等待读取协程退出后再关闭事件channel
+func (r *logEventReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.openOnce.Do(func() {}) //未打开时不再允许打开
+		r.wg.Wait()
+		close(r.ipchain)
+	})
+	return nil
+}
+
+func (r *logEventReader) handleLine(ctx context.Context, file string, ms []*matcher, line string) {
+	for _, m := range ms {
+		ip, ok := m.match(line)
+		if !ok {
+			continue
+		}
+		now := time.Now().UnixMilli()
+		if !m.check(ip, now) {
+			continue
+		}
+		logutil.GetLogger(ctx).Debug("recv log match", zap.String("ip", ip), zap.String("rule", m.name), zap.String("file", file))
+		ev := event.NewEventData(string(event.EventTypeLogMatch), now, &LogEventData{
+			IP:   ip,
+			Rule: m.name,
+			File: file,
+			Line: line,
+		})
+		select {
+		case r.ipchain <- ev:
+			metrics.EventsEmitted.WithLabelValues(r.Name(), string(event.EventTypeLogMatch)).Inc()
+		default: //队列已满时丢弃, 避免阻塞读取
+			metrics.EventsDropped.WithLabelValues(r.Name(), string(event.EventTypeLogMatch)).Inc()
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package logevent
+
+import (
+	"context"
+	"ip-blackcage/event"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresetMatch(t *testing.T) {
+	tests := []struct {
+		preset string
+		line   string
+		ip     string
+	}{
+		{PresetSSHD, "Oct 18 10:00:01 host sshd[123]: Failed password for root from 1.2.3.4 port 2222 ssh2", "1.2.3.4"},
+		{PresetSSHD, "Oct 18 10:00:01 host sshd[123]: Failed password for invalid user admin from 2001:db8::1 port 2222 ssh2", "2001:db8::1"},
+		{PresetSSHD, "Oct 18 10:00:01 host sshd[123]: Invalid user test from 5.6.7.8 port 4444", "5.6.7.8"},
+		{PresetNginx, `9.9.9.9 - - [18/Oct/2026:10:00:01 +0800] "GET /.env HTTP/1.1" 404 153 "-" "curl/8.0"`, "9.9.9.9"},
+		{PresetApache, `9.9.9.8 - - [18/Oct/2026:10:00:01 +0800] "GET /wp-login.php HTTP/1.1" 403 199`, "9.9.9.8"},
+		{PresetPostfixSASL, "Oct 18 10:00:01 host postfix/smtpd[1]: warning: unknown[7.7.7.7]: SASL LOGIN authentication failed: UGFzc3dvcmQ6", "7.7.7.7"},
+	}
+	for _, tt := range tests {
+		m, err := newMatcher(&Rule{Name: tt.preset, Preset: tt.preset})
+		assert.NoError(t, err)
+		ip, ok := m.match(tt.line)
+		assert.True(t, ok, tt.line)
+		assert.Equal(t, tt.ip, ip)
+	}
+	m, err := newMatcher(&Rule{Name: "nginx", Preset: PresetNginx})
+	assert.NoError(t, err)
+	_, ok := m.match(`9.9.9.9 - - [18/Oct/2026:10:00:01 +0800] "GET / HTTP/1.1" 200 153`)
+	assert.False(t, ok)
+}
+
+func TestInvalidRule(t *testing.T) {
+	_, err := newMatcher(&Rule{Name: "x", Preset: "unknown"})
+	assert.Error(t, err)
+	_, err = newMatcher(&Rule{Name: "x", Files: []string{"/tmp/a"}, Patterns: []string{`from (\S+)`}})
+	assert.Error(t, err)
+}
+
+func TestThreshold(t *testing.T) {
+	m, err := newMatcher(&Rule{Name: "ssh", Preset: PresetSSHD, Threshold: 2})
+	assert.NoError(t, err)
+	assert.False(t, m.check("1.2.3.4", 1000))
+	assert.True(t, m.check("1.2.3.4", 2000))
+}
+
+func TestReaderClose(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "auth.log")
+	r, err := NewLogEventReader(
+		WithRule(&Rule{Name: "ssh", Preset: PresetSSHD, Files: []string{f}}),
+		WithPollInterval(10*time.Millisecond),
+	)
+	assert.NoError(t, err)
+	ch, err := r.Open(context.Background())
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, f, "sshd[1]: Invalid user test from 5.6.7.8 port 4444\n")
+	select {
+	case ev := <-ch:
+		assert.Equal(t, string(event.EventTypeLogMatch), ev.EventType())
+		assert.Equal(t, "5.6.7.8", ev.Data().(*LogEventData).IP)
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "wait event timeout")
+	}
+	assert.NoError(t, r.Close())
+	_, ok := <-ch
+	assert.False(t, ok)
+	assert.NoError(t, r.Close())
+}
@@ -0,0 +1,21 @@
+package logevent
+
+import "time"
+
+// Rule 日志匹配规则, Patterns中的正则需要包含名为ip的命名分组
+// 同一ip在Window内命中Threshold次后才产生事件, Threshold<=1时每次命中都产生事件
+type Rule struct {
+	Name      string
+	Preset    string //可选, 内置规则名, 会补齐Files/Patterns
+	Files     []string
+	Patterns  []string
+	Threshold int
+	Window    time.Duration
+}
+
+type LogEventData struct {
+	IP   string
+	Rule string //命中的规则名
+	File string
+	Line string
+}
@@ -0,0 +1,66 @@
+package logevent
+
+import "fmt"
+
+const (
+	PresetSSHD        = "sshd"
+	PresetNginx       = "nginx"
+	PresetApache      = "apache"
+	PresetPostfixSASL = "postfix-sasl"
+)
+
+const (
+	ipExpr = `(?P<ip>[0-9a-fA-F:.]+)`
+	//combined/common格式的访问日志, 4xx视为探测
+	accessLog4xxExpr = `^` + ipExpr + ` \S+ \S+ \[[^\]]+\] "[^"]*" 4\d\d `
+)
+
+type preset struct {
+	files    []string
+	patterns []string
+}
+
+var presets = map[string]*preset{
+	PresetSSHD: {
+		files: []string{"/var/log/auth.log", "/var/log/secure"},
+		patterns: []string{
+			`Failed (?:password|publickey|none) for (?:invalid user )?\S* from ` + ipExpr + ` port \d+`,
+			`Invalid user \S* from ` + ipExpr,
+			`maximum authentication attempts exceeded for (?:invalid user )?\S* from ` + ipExpr,
+			`Connection closed by (?:authenticating|invalid) user \S* ` + ipExpr + ` port \d+ \[preauth\]`,
+			`Did not receive identification string from ` + ipExpr,
+		},
+	},
+	PresetNginx: {
+		files:    []string{"/var/log/nginx/access.log"},
+		patterns: []string{accessLog4xxExpr},
+	},
+	PresetApache: {
+		files:    []string{"/var/log/apache2/access.log", "/var/log/httpd/access_log"},
+		patterns: []string{accessLog4xxExpr},
+	},
+	PresetPostfixSASL: {
+		files: []string{"/var/log/mail.log", "/var/log/maillog"},
+		patterns: []string{
+			`warning: [-._\w]+\[` + ipExpr + `\]: SASL \S+ authentication failed`,
+		},
+	},
+}
+
+// applyPreset 使用内置规则补齐未配置的文件及正则, 用户配置优先
+func applyPreset(r *Rule) error {
+	if len(r.Preset) == 0 {
+		return nil
+	}
+	p, ok := presets[r.Preset]
+	if !ok {
+		return fmt.Errorf("unknown preset:%s", r.Preset)
+	}
+	if len(r.Files) == 0 {
+		r.Files = append(r.Files, p.files...)
+	}
+	if len(r.Patterns) == 0 {
+		r.Patterns = append(r.Patterns, p.patterns...)
+	}
+	return nil
+}
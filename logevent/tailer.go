@@ -0,0 +1,134 @@
+package logevent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+type lineFunc func(line string)
+
+// tailer 以轮询的方式跟踪文件新增的行, 处理logrotate的rename/create以及copytruncate两种轮转方式
+type tailer struct {
+	path      string
+	f         *os.File
+	rd        *bufio.Reader
+	offset    int64
+	partial   string
+	fromStart bool //首次打开时跳过已有内容, 轮转后的新文件需要从头读取
+}
+
+func newTailer(path string) *tailer {
+	return &tailer{path: path}
+}
+
+func (t *tailer) run(ctx context.Context, interval time.Duration, fn lineFunc) {
+	defer t.close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := t.poll(fn); err != nil {
+			logutil.GetLogger(ctx).Error("tail file failed", zap.String("file", t.path), zap.Error(err))
+			t.close()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *tailer) open() (bool, error) {
+	f, err := os.Open(t.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) { //文件暂时不存在, 等待创建
+			t.fromStart = true
+			return false, nil
+		}
+		return false, err
+	}
+	var offset int64
+	if !t.fromStart {
+		if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return false, err
+		}
+	}
+	t.f = f
+	t.rd = bufio.NewReader(f)
+	t.offset = offset
+	t.partial = ""
+	return true, nil
+}
+
+func (t *tailer) close() {
+	if t.f == nil {
+		return
+	}
+	t.f.Close()
+	t.f = nil
+	t.rd = nil
+}
+
+// poll 读取新增的完整行, 并检查文件是否被截断或轮转
+func (t *tailer) poll(fn lineFunc) error {
+	if t.f == nil {
+		ok, err := t.open()
+		if err != nil || !ok {
+			return err
+		}
+	}
+	st, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() < t.offset { //copytruncate, 从头开始读
+		if _, err := t.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		t.rd.Reset(t.f)
+		t.offset = 0
+		t.partial = ""
+	}
+	if err := t.readLines(fn); err != nil {
+		return err
+	}
+	cur, err := os.Stat(t.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil && os.SameFile(st, cur) {
+		return nil
+	}
+	//文件已被rename或删除, 旧文件的内容已经读完, 下一轮从头读取新文件
+	t.close()
+	t.fromStart = true
+	return nil
+}
+
+func (t *tailer) readLines(fn lineFunc) error {
+	for {
+		line, err := t.rd.ReadString('\n')
+		t.offset += int64(len(line))
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				t.partial += line //不完整的行等待下一轮补齐
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimRight(t.partial+line, "\r\n")
+		t.partial = ""
+		if len(line) > 0 {
+			fn(line)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package logevent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func appendFile(t *testing.T, f string, data string) {
+	fp, err := os.OpenFile(f, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	defer fp.Close()
+	_, err = fp.WriteString(data)
+	assert.NoError(t, err)
+}
+
+func TestTailer(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "auth.log")
+	appendFile(t, f, "old line\n")
+	lines := make([]string, 0, 8)
+	fn := func(line string) { lines = append(lines, line) }
+	tl := newTailer(f)
+	defer tl.close()
+	//首次打开跳过已有内容
+	assert.NoError(t, tl.poll(fn))
+	assert.Empty(t, lines)
+	//不完整的行等待补齐
+	appendFile(t, f, "line1\nline")
+	assert.NoError(t, tl.poll(fn))
+	assert.Equal(t, []string{"line1"}, lines)
+	appendFile(t, f, "2\n")
+	assert.NoError(t, tl.poll(fn))
+	assert.Equal(t, []string{"line1", "line2"}, lines)
+	//copytruncate
+	assert.NoError(t, os.Truncate(f, 0))
+	appendFile(t, f, "l3\n")
+	assert.NoError(t, tl.poll(fn))
+	assert.Equal(t, []string{"line1", "line2", "l3"}, lines)
+	//rename + create, 旧文件的剩余内容与新文件的全部内容都需要读到
+	appendFile(t, f, "line4\n")
+	assert.NoError(t, os.Rename(f, f+".1"))
+	appendFile(t, f, "line5\n")
+	assert.NoError(t, tl.poll(fn))
+	assert.NoError(t, tl.poll(fn))
+	assert.Equal(t, []string{"line1", "line2", "l3", "line4", "line5"}, lines)
+}
+
+func TestTailerFileNotExist(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "mail.log")
+	lines := make([]string, 0, 2)
+	fn := func(line string) { lines = append(lines, line) }
+	tl := newTailer(f)
+	defer tl.close()
+	assert.NoError(t, tl.poll(fn))
+	appendFile(t, f, "line1\n")
+	assert.NoError(t, tl.poll(fn))
+	assert.Equal(t, []string{"line1"}, lines)
+}
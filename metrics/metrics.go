@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	namespace = "ip_blackcage"
+)
+
+// 封禁/解封原因
+const (
+	ReasonEvent    = "event"
+	ReasonManual   = "manual"
+	ReasonUserList = "user_list"
+	ReasonExpired  = "expired"
+	ReasonSubnet   = "subnet"
+	ReasonEvicted  = "evicted"
+)
+
+// 事件处理结果
+const (
+	ResultSucc = "succ"
+	ResultFail = "fail"
+)
+
+var (
+	CapturedPackets = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "captured_packets_total",
+		Help:      "Packets captured by the event reader.",
+	})
+	EventsEmitted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_emitted_total",
+		Help:      "Events emitted by the event readers, by source and event type.",
+	}, []string{"source", "type"})
+	EventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_dropped_total",
+		Help:      "Events dropped because the reader queue is full, by source and event type.",
+	}, []string{"source", "type"})
+	EventsHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_handled_total",
+		Help:      "Events handled by the cage, by source, event type and result.",
+	}, []string{"source", "type", "result"})
+	Bans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bans_total",
+		Help:      "IPs banned, by reason and destination port.",
+	}, []string{"reason", "port"})
+	Unbans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unbans_total",
+		Help:      "IPs unbanned, by reason.",
+	}, []string{"reason"})
+	DBErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_errors_total",
+		Help:      "Failed DB operations, by operation.",
+	}, []string{"op"})
+	IPSetCmdDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ipset_cmd_duration_seconds",
+		Help:      "Latency of ipset commands, by command.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"cmd"})
+	IPSetCmdFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ipset_cmd_failures_total",
+		Help:      "Failed ipset commands, by command.",
+	}, []string{"cmd"})
+	SetEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "set_entries",
+		Help:      "Current entries in the kernel sets, by set name.",
+	}, []string{"set"})
+	FirewallDrift = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "firewall_drift_total",
+		Help:      "Firewall drifts detected and repaired, by kind.",
+	}, []string{"kind"})
+	CageCapacity = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cage_capacity",
+		Help:      "Configured max entries of the black list set (cage_size).",
+	})
+	CageUsage = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cage_usage_ratio",
+		Help:      "Highest usage ratio among active bans against cage_size and each kernel set against its capacity.",
+	})
+	CageOverflow = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cage_overflow_total",
+		Help:      "Bans that hit the cage capacity, by action (reject/evict).",
+	}, []string{"action"})
+)
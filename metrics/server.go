@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+type IServer interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+type defaultServer struct {
+	listen string
+	svr    *http.Server
+}
+
+// NewServer 创建用于暴露/metrics的http服务
+func NewServer(listen string) (IServer, error) {
+	if len(listen) == 0 {
+		return nil, fmt.Errorf("no listen addr found")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	return &defaultServer{
+		listen: listen,
+		svr: &http.Server{
+			Addr:              listen,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+func (s *defaultServer) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		return fmt.Errorf("listen metrics addr:%s failed, err:%w", s.listen, err)
+	}
+	go func() {
+		if err := s.svr.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logutil.GetLogger(ctx).Error("metrics server exit", zap.Error(err))
+		}
+	}()
+	logutil.GetLogger(ctx).Info("metrics server started", zap.String("listen", s.listen))
+	return nil
+}
+
+func (s *defaultServer) Stop(ctx context.Context) error {
+	return s.svr.Shutdown(ctx)
+}
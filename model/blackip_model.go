@@ -1,14 +1,60 @@
 package model
 
+import (
+	"math"
+	"time"
+)
+
+const (
+	// ExpireAtPermanent 永久拦截的过期时间
+	ExpireAtPermanent uint64 = math.MaxInt64
+	// BanDurationAuto 按照封禁阶梯自动选择封禁时长
+	BanDurationAuto time.Duration = -1
+)
+
+// 封禁原因
+const (
+	BanReasonEvent  = "event"
+	BanReasonManual = "manual"
+	BanReasonSubnet = "subnet"
+)
+
 type BlackCageTab struct {
-	ID      uint64 `json:"id"`
-	Remark  string `json:"remark"`
-	CTime   uint64 `json:"ctime"`
-	MTime   uint64 `json:"mtime"`
-	IP      string `json:"ip"`
-	Counter int64  `json:"counter"`
+	ID        uint64 `json:"id"`
+	Remark    string `json:"remark"` //补充说明, 例如手动封禁时填写的原因; 旧版本写入的记录为拼接后的封禁原因
+	CTime     uint64 `json:"ctime"`
+	MTime     uint64 `json:"mtime"`
+	IP        string `json:"ip"`
+	Counter   int64  `json:"counter"`
+	ExpireAt  uint64 `json:"expire_at"` //过期时间(毫秒), 0表示旧版本写入的记录, 尚未设置过期时间
+	Scope     string `json:"scope"`     //封禁范围, 为空表示封禁全部流量
+	Reason    string `json:"reason"`    //封禁原因, 见BanReasonXXX, 旧版本写入的记录为空
+	EventType string `json:"event_type"`
+	Rule      string `json:"rule"` //触发封禁的规则
+	Protocol  string `json:"protocol"`
+	DstPort   uint64 `json:"dst_port"`
+	Iface     string `json:"iface"`
+}
+
+// BanReason 结构化的封禁原因, 与BlackCageTab中的同名字段对应
+type BanReason struct {
+	Reason    string
+	EventType string
+	Rule      string
+	Protocol  string
+	DstPort   uint16
+	Iface     string
+	Remark    string
+}
+
+// BlackIPVisit 合并后的访问计数增量, 由写缓冲批量落库
+type BlackIPVisit struct {
+	IP    string
+	Count int64
+	MTime uint64
 }
 
 type ListBlackIPCondition struct {
 	MtimeBetween []uint64
+	IPPrefix     string
 }
@@ -0,0 +1,11 @@
+package model
+
+import "errors"
+
+// 供管理接口区分客户端错误的哨兵错误, 业务错误通过%w包装后返回
+var (
+	// ErrInvalidArgument 参数不合法
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrConflict 请求与当前状态冲突, 例如ip处于白名单中或者容量已满
+	ErrConflict = errors.New("conflict with current state")
+)
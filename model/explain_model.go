@@ -0,0 +1,16 @@
+package model
+
+// IPExplain 解释某个ip当前为何被拦截/放行
+type IPExplain struct {
+	IP                string        `json:"ip"`
+	Blocked           bool          `json:"blocked"`
+	Whitelisted       bool          `json:"whitelisted"`
+	DBRecord          *BlackCageTab `json:"db_record,omitempty"`
+	DBActive          bool          `json:"db_active"`
+	CoveredBy         string        `json:"covered_by,omitempty"` //ip处于合并后的网段封禁中时, DBRecord为该网段的记录
+	BanCount          int64         `json:"ban_count"`
+	UserBlackList     []string      `json:"user_black_list,omitempty"` //命中的用户黑名单条目
+	UserWhiteList     []string      `json:"user_white_list,omitempty"` //命中的用户白名单条目
+	LocalNetwork      []string      `json:"local_network,omitempty"`   //命中的内网保护条目
+	TempWhiteExpireAt uint64        `json:"temp_white_expire_at,omitempty"`
+}
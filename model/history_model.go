@@ -0,0 +1,31 @@
+package model
+
+// 事件的处理结果
+const (
+	HistoryActionBan   = "ban"   //触发了新的封禁
+	HistoryActionHit   = "hit"   //来源已处于封禁中
+	HistoryActionPass  = "pass"  //未满足封禁规则或者处于观察模式
+	HistoryActionWhite = "white" //来源命中白名单
+	HistoryActionFail  = "fail"  //处理失败
+)
+
+// EventHistoryTab 每一次事件的记录, 用于事后复盘, 按保留策略定期清理
+type EventHistoryTab struct {
+	ID        uint64 `json:"id"`
+	TS        uint64 `json:"ts"` //事件时间(毫秒)
+	EventType string `json:"event_type"`
+	Protocol  string `json:"protocol"`
+	SrcIP     string `json:"src_ip"`
+	SrcPort   uint64 `json:"src_port"`
+	DstIP     string `json:"dst_ip"`
+	DstPort   uint64 `json:"dst_port"`
+	Iface     string `json:"iface"`
+	Rule      string `json:"rule"`
+	Action    string `json:"action"`
+	Detail    string `json:"detail"` //补充信息, 例如日志事件命中的文件及行内容, 合并的记录保留最近5条, 以换行分隔
+	Count     int64  `json:"count"`  //写缓冲周期内合并的相同事件数, ts为其中首个事件的时间
+}
+
+type ListEventHistoryCondition struct {
+	SrcIP string
+}
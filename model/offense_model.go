@@ -0,0 +1,10 @@
+package model
+
+// OffenseTab ip的历史被封禁记录, 解封后依然保留, 用于重复违规时的逐级加重
+type OffenseTab struct {
+	ID       uint64 `json:"id"`
+	IP       string `json:"ip"`
+	BanCount int64  `json:"ban_count"`
+	CTime    uint64 `json:"ctime"`
+	MTime    uint64 `json:"mtime"`
+}
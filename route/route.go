@@ -2,47 +2,119 @@ package route
 
 import (
 	"fmt"
-	"net"
 
 	"github.com/vishvananda/netlink"
 )
 
-func DetectExitInterface() (string, error) {
-	lst, err := netlink.RouteList(nil, netlink.FAMILY_V4)
-	if err != nil {
-		return "", err
-	}
-	_, ipnet, err := net.ParseCIDR("0.0.0.0/0")
+func detectExitInterfaceByFamily(family int) (string, bool, error) {
+	lst, err := netlink.RouteList(nil, family)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
-	sipnet := ipnet.String()
 	for _, item := range lst {
-		if item.Dst.String() != sipnet {
+		if !isDefaultRoute(item) {
 			continue
 		}
-		iface, err := netlink.LinkByIndex(item.LinkIndex)
+		idx := item.LinkIndex
+		if idx <= 0 && len(item.MultiPath) > 0 { //多路径默认路由的网卡记录在各个下一跳中
+			idx = item.MultiPath[0].LinkIndex
+		}
+		if idx <= 0 {
+			continue
+		}
+		iface, err := netlink.LinkByIndex(idx)
 		if err != nil {
-			return "", err
+			return "", false, err
 		}
 		ifacename := iface.Attrs().Name
-		return ifacename, nil
+		return ifacename, true, nil
+	}
+	return "", false, nil
+}
+
+// DetectExitInterface 查找默认路由所在的网卡, 优先使用ipv4, 不存在时再使用ipv6的默认路由
+func DetectExitInterface() (string, error) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		name, ok, err := detectExitInterfaceByFamily(family)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return name, nil
+		}
 	}
 	return "", fmt.Errorf("unable to found default network interface")
 }
 
+// ReadExitIP 读取网卡上的ipv4/ipv6地址, 链路本地地址(如fe80::/10)不会作为出口ip返回
 func ReadExitIP(ifaceName string) ([]string, error) {
 	link, err := netlink.LinkByName(ifaceName)
 	if err != nil {
 		return nil, err
 	}
-	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
 	if err != nil {
 		return nil, err
 	}
 	rs := make([]string, 0, len(addrs))
 	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() || addr.IP.IsLinkLocalMulticast() {
+			continue
+		}
 		rs = append(rs, addr.IP.String())
 	}
 	return rs, nil
 }
+
+func isDefaultRoute(item netlink.Route) bool {
+	if item.Dst == nil {
+		return true
+	}
+	ones, _ := item.Dst.Mask.Size()
+	return ones == 0
+}
+
+// DetectExitInterfaces 查找所有带默认路由的网卡(含ipv4/ipv6及多路径路由), 结果已去重
+func DetectExitInterfaces() ([]string, error) {
+	rs := make([]string, 0, 2)
+	exist := make(map[string]struct{})
+	addFn := func(idx int) error {
+		if idx <= 0 {
+			return nil
+		}
+		link, err := netlink.LinkByIndex(idx)
+		if err != nil {
+			return err
+		}
+		name := link.Attrs().Name
+		if _, ok := exist[name]; ok {
+			return nil
+		}
+		exist[name] = struct{}{}
+		rs = append(rs, name)
+		return nil
+	}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		lst, err := netlink.RouteList(nil, family)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range lst {
+			if !isDefaultRoute(item) {
+				continue
+			}
+			if err := addFn(item.LinkIndex); err != nil {
+				return nil, err
+			}
+			for _, hop := range item.MultiPath {
+				if err := addFn(hop.LinkIndex); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if len(rs) == 0 {
+		return nil, fmt.Errorf("unable to found default network interface")
+	}
+	return rs, nil
+}
@@ -0,0 +1,35 @@
+package rule
+
+const (
+	defaultMaxTrackIPs = 65536
+)
+
+type config struct {
+	rules       []*Rule
+	maxTrackIPs int
+}
+
+type Option func(c *config)
+
+func WithRule(rs ...*Rule) Option {
+	return func(c *config) {
+		c.rules = append(c.rules, rs...)
+	}
+}
+
+// WithMaxTrackIPs 内存中最多跟踪的来源ip数, 超出后淘汰最久未出现的ip
+func WithMaxTrackIPs(n int) Option {
+	return func(c *config) {
+		c.maxTrackIPs = n
+	}
+}
+
+func applyOpts(opts ...Option) *config {
+	c := &config{
+		maxTrackIPs: defaultMaxTrackIPs,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
@@ -0,0 +1,132 @@
+package rule
+
+import (
+	"container/list"
+	"sync"
+)
+
+type IRuleEngine interface {
+	// Check 记录一次命中并判断是否满足任意一条规则, 满足时返回命中的规则, 该事件类型未配置规则时规则为nil
+	Check(ip string, evType string, iface string, protocol string, port uint16, ts int64) (*Rule, bool)
+}
+
+type hitState struct {
+	hits  []int64          //窗口内的命中时间, 最多保留Threshold个
+	ports map[uint16]int64 //端口最后一次命中时间, 最多保留DistinctPorts个
+}
+
+type ipState struct {
+	ip     string
+	states []*hitState //与规则一一对应
+}
+
+type defaultEngine struct {
+	c     *config
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+func NewEngine(opts ...Option) (IRuleEngine, error) {
+	c := applyOpts(opts...)
+	if c.maxTrackIPs <= 0 {
+		c.maxTrackIPs = defaultMaxTrackIPs
+	}
+	return &defaultEngine{
+		c:     c,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}, nil
+}
+
+func (e *defaultEngine) getState(ip string) *ipState {
+	if elem, ok := e.items[ip]; ok {
+		e.lru.MoveToFront(elem)
+		return elem.Value.(*ipState)
+	}
+	st := &ipState{ip: ip, states: make([]*hitState, len(e.c.rules))}
+	e.items[ip] = e.lru.PushFront(st)
+	for e.lru.Len() > e.c.maxTrackIPs {
+		last := e.lru.Back()
+		e.lru.Remove(last)
+		delete(e.items, last.Value.(*ipState).ip)
+	}
+	return st
+}
+
+func (e *defaultEngine) removeState(ip string) {
+	elem, ok := e.items[ip]
+	if !ok {
+		return
+	}
+	e.lru.Remove(elem)
+	delete(e.items, ip)
+}
+
+func (e *defaultEngine) Check(ip string, evType string, iface string, protocol string, port uint16, ts int64) (*Rule, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var st *ipState
+	scoped := false
+	for idx, r := range e.c.rules {
+		if !r.matchEventType(evType) {
+			continue
+		}
+		scoped = true
+		if !r.match(iface, protocol, port) {
+			continue
+		}
+		if st == nil {
+			st = e.getState(ip)
+		}
+		if st.states[idx] == nil {
+			st.states[idx] = &hitState{}
+		}
+		if evalRule(r, st.states[idx], port, ts) {
+			e.removeState(ip)
+			return r, true
+		}
+	}
+	if !scoped { //该事件类型未配置规则时, 命中即封禁
+		return nil, true
+	}
+	return nil, false
+}
+
+func evalRule(r *Rule, st *hitState, port uint16, ts int64) bool {
+	var delims int64 //窗口为0时不限制时间
+	if r.Window > 0 {
+		delims = ts - r.Window.Milliseconds()
+	}
+	threshold := r.Threshold
+	if threshold <= 0 {
+		threshold = 1
+	}
+	st.hits = append(st.hits, ts)
+	start := 0
+	for start < len(st.hits) && (st.hits[start] <= delims || len(st.hits)-start > threshold) {
+		start++
+	}
+	st.hits = append(st.hits[:0], st.hits[start:]...)
+	if r.DistinctPorts > 0 {
+		if st.ports == nil {
+			st.ports = make(map[uint16]int64, r.DistinctPorts)
+		}
+		st.ports[port] = ts
+		for p, t := range st.ports {
+			if t <= delims {
+				delete(st.ports, p)
+			}
+		}
+		for len(st.ports) > r.DistinctPorts {
+			oldestPort, oldestTs := port, ts
+			for p, t := range st.ports {
+				if t < oldestTs {
+					oldestPort, oldestTs = p, t
+				}
+			}
+			delete(st.ports, oldestPort)
+		}
+	}
+	return len(st.hits) >= threshold && len(st.ports) >= r.DistinctPorts
+}
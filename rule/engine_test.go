@@ -0,0 +1,101 @@
+package rule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoRule(t *testing.T) {
+	e, err := NewEngine()
+	assert.NoError(t, err)
+	_, ok := e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 22, 1000)
+	assert.True(t, ok)
+}
+
+func TestThresholdInWindow(t *testing.T) {
+	e, err := NewEngine(WithRule(&Rule{Name: "burst", Threshold: 3, Window: 10 * time.Second}))
+	assert.NoError(t, err)
+	_, ok := e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 22, 1000)
+	assert.False(t, ok)
+	_, ok = e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 22, 2000)
+	assert.False(t, ok)
+	//第一次命中已经滑出窗口
+	_, ok = e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 22, 11500)
+	assert.False(t, ok)
+	r, ok := e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 22, 11800)
+	assert.True(t, ok)
+	assert.Equal(t, "burst", r.Name)
+	//触发后状态被重置
+	_, ok = e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 22, 12500)
+	assert.False(t, ok)
+}
+
+func TestProtocolAndPort(t *testing.T) {
+	e, err := NewEngine(WithRule(&Rule{Name: "ssh", Protocol: "tcp", Ports: []uint16{22}, Threshold: 1}))
+	assert.NoError(t, err)
+	_, ok := e.Check("1.2.3.4", "port_scan", "eth0", "udp", 22, 1000)
+	assert.False(t, ok)
+	_, ok = e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 23, 1000)
+	assert.False(t, ok)
+	_, ok = e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 22, 1000)
+	assert.True(t, ok)
+}
+
+func TestInterface(t *testing.T) {
+	e, err := NewEngine(WithRule(&Rule{Name: "wan", Interfaces: []string{"ppp0", "wg0"}, Threshold: 1}))
+	assert.NoError(t, err)
+	_, ok := e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 22, 1000)
+	assert.False(t, ok)
+	r, ok := e.Check("1.2.3.4", "port_scan", "wg0", "tcp", 22, 1000)
+	assert.True(t, ok)
+	assert.Equal(t, "wan", r.Name)
+}
+
+func TestEventType(t *testing.T) {
+	e, err := NewEngine(
+		WithRule(&Rule{Name: "ssh", Protocol: "tcp", Ports: []uint16{22}, Threshold: 1}),
+		WithRule(&Rule{Name: "log", EventTypes: []string{"log_match"}, Threshold: 2}),
+	)
+	assert.NoError(t, err)
+	_, ok := e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 23, 1000)
+	assert.False(t, ok)
+	_, ok = e.Check("1.2.3.4", "log_match", "", "", 0, 1000)
+	assert.False(t, ok)
+	r, ok := e.Check("1.2.3.4", "log_match", "", "", 0, 2000)
+	assert.True(t, ok)
+	assert.Equal(t, "log", r.Name)
+	//未配置规则的事件类型命中即封禁
+	_, ok = e.Check("1.2.3.4", "api", "", "", 0, 3000)
+	assert.True(t, ok)
+}
+
+func TestDistinctPorts(t *testing.T) {
+	e, err := NewEngine(WithRule(&Rule{Name: "sweep", Threshold: 1, DistinctPorts: 3, Window: time.Minute}))
+	assert.NoError(t, err)
+	_, ok := e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 1, 1000)
+	assert.False(t, ok)
+	_, ok = e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 1, 2000)
+	assert.False(t, ok)
+	_, ok = e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 2, 3000)
+	assert.False(t, ok)
+	_, ok = e.Check("5.6.7.8", "port_scan", "eth0", "tcp", 3, 3000)
+	assert.False(t, ok)
+	_, ok = e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 3, 4000)
+	assert.True(t, ok)
+}
+
+func TestMaxTrackIPs(t *testing.T) {
+	e, err := NewEngine(WithRule(&Rule{Name: "burst", Threshold: 2}), WithMaxTrackIPs(1))
+	assert.NoError(t, err)
+	_, ok := e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 22, 1000)
+	assert.False(t, ok)
+	_, ok = e.Check("5.6.7.8", "port_scan", "eth0", "tcp", 22, 1000)
+	assert.False(t, ok)
+	//1.2.3.4已经被淘汰, 重新计数
+	_, ok = e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 22, 2000)
+	assert.False(t, ok)
+	_, ok = e.Check("1.2.3.4", "port_scan", "eth0", "tcp", 22, 3000)
+	assert.True(t, ok)
+}
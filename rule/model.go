@@ -0,0 +1,53 @@
+package rule
+
+import (
+	"ip-blackcage/event"
+	"time"
+)
+
+// Rule 封禁规则, 来源ip在Window内命中Threshold次且至少访问了DistinctPorts个不同端口时触发封禁
+type Rule struct {
+	Name          string
+	Protocol      string   //为空时匹配全部协议
+	Ports         []uint16 //为空时匹配全部端口
+	Threshold     int
+	Window        time.Duration
+	DistinctPorts int
+	Interfaces    []string //为空时匹配全部网卡
+	EventTypes    []string //为空时只作用于端口扫描事件, 与引入多事件来源之前的行为保持一致
+	Scope         string   //触发后使用的封禁范围, 为空时封禁全部流量
+}
+
+func (r *Rule) matchEventType(evType string) bool {
+	if len(r.EventTypes) == 0 {
+		return evType == string(event.EventTypePortScan)
+	}
+	return containsString(r.EventTypes, evType)
+}
+
+func (r *Rule) match(iface string, protocol string, port uint16) bool {
+	if len(r.Protocol) > 0 && r.Protocol != protocol {
+		return false
+	}
+	if len(r.Interfaces) > 0 && !containsString(r.Interfaces, iface) {
+		return false
+	}
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, p := range r.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package userlist
+
+import (
+	"context"
+	"fmt"
+	"ip-blackcage/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/xxxsen/common/logutil"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDebounce = 1 * time.Second
+)
+
+// Diff 两次读取之间的ip变化
+type Diff struct {
+	Added   []string
+	Removed []string
+}
+
+type OnChangeFunc func(ctx context.Context, diff *Diff)
+
+type IWatcher interface {
+	// Load 读取目录下全部匹配前缀的文件, 并作为后续比对的基准
+	Load(ctx context.Context) ([]string, error)
+	// Watch 监听目录变化, 文件新增/删除/修改后将差异通过fn回调
+	Watch(ctx context.Context, fn OnChangeFunc) error
+	// Contains 名单中是否存在与entry完全一致的条目
+	Contains(entry string) bool
+	// Match 返回名单中包含该ip的全部条目
+	Match(ip string) []string
+	Close() error
+}
+
+type defaultWatcher struct {
+	dir     string
+	prefix  string
+	mu      sync.Mutex
+	current map[string]struct{}
+	fw      *fsnotify.Watcher
+}
+
+func NewWatcher(dir string, prefix string) (IWatcher, error) {
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("no dir found")
+	}
+	return &defaultWatcher{dir: dir, prefix: prefix, current: make(map[string]struct{})}, nil
+}
+
+// ResolveFiles 返回目录下以prefix开头的文件
+func ResolveFiles(dir string, prefix string) ([]string, error) {
+	if len(dir) == 0 {
+		return nil, nil
+	}
+	rs := make([]string, 0, 32)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, ent := range entries {
+		if ent.IsDir() {
+			continue
+		}
+		name := filepath.Base(ent.Name())
+		if strings.HasPrefix(name, prefix) {
+			rs = append(rs, filepath.Join(dir, ent.Name()))
+		}
+	}
+	return rs, nil
+}
+
+func (w *defaultWatcher) read() (map[string]struct{}, error) {
+	files, err := ResolveFiles(w.dir, w.prefix)
+	if err != nil {
+		return nil, err
+	}
+	rs := make(map[string]struct{}, 1024)
+	for _, f := range files {
+		ips, err := utils.ReadIPListFromFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read ip list from file:%s failed, err:%w", f, err)
+		}
+		for _, ip := range ips {
+			rs[ip] = struct{}{}
+		}
+	}
+	return rs, nil
+}
+
+func (w *defaultWatcher) Load(_ context.Context) ([]string, error) {
+	m, err := w.read()
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.current = m
+	rs := make([]string, 0, len(m))
+	for ip := range m {
+		rs = append(rs, ip)
+	}
+	sort.Strings(rs)
+	return rs, nil
+}
+
+func diffIPSet(old, cur map[string]struct{}) *Diff {
+	d := &Diff{}
+	for ip := range cur {
+		if _, ok := old[ip]; !ok {
+			d.Added = append(d.Added, ip)
+		}
+	}
+	for ip := range old {
+		if _, ok := cur[ip]; !ok {
+			d.Removed = append(d.Removed, ip)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	return d
+}
+
+func (w *defaultWatcher) reload(ctx context.Context, fn OnChangeFunc) {
+	m, err := w.read()
+	if err != nil { //文件可能还在编辑中, 保留上一次的结果
+		logutil.GetLogger(ctx).Error("reload user ip list failed", zap.String("dir", w.dir), zap.Error(err))
+		return
+	}
+	w.mu.Lock()
+	d := diffIPSet(w.current, m)
+	w.current = m
+	w.mu.Unlock()
+	if len(d.Added) == 0 && len(d.Removed) == 0 {
+		return
+	}
+	logutil.GetLogger(ctx).Info("user ip list changed", zap.String("dir", w.dir),
+		zap.Int("added", len(d.Added)), zap.Int("removed", len(d.Removed)))
+	fn(ctx, d)
+}
+
+func (w *defaultWatcher) isTarget(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), w.prefix)
+}
+
+func (w *defaultWatcher) Watch(ctx context.Context, fn OnChangeFunc) error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("create fs watcher failed, err:%w", err)
+	}
+	if err := fw.Add(w.dir); err != nil {
+		_ = fw.Close()
+		return fmt.Errorf("watch dir:%s failed, err:%w", w.dir, err)
+	}
+	w.fw = fw
+	go w.loop(ctx, fw, fn)
+	return nil
+}
+
+func (w *defaultWatcher) loop(ctx context.Context, fw *fsnotify.Watcher, fn OnChangeFunc) {
+	//编辑器保存文件时往往会产生多个事件, 合并后再统一处理
+	timer := time.NewTimer(defaultDebounce)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case ev, ok := <-fw.Events:
+			if !ok {
+				return
+			}
+			if !w.isTarget(ev.Name) || ev.Op == fsnotify.Chmod {
+				continue
+			}
+			timer.Reset(defaultDebounce)
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return
+			}
+			logutil.GetLogger(ctx).Error("watch user ip list failed", zap.String("dir", w.dir), zap.Error(err))
+		case <-timer.C:
+			w.reload(ctx, fn)
+		}
+	}
+}
+
+func (w *defaultWatcher) Contains(entry string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.current[entry]
+	return ok
+}
+
+func (w *defaultWatcher) Match(ip string) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rs := make([]string, 0, 4)
+	for entry := range w.current {
+		if ok, _ := utils.IPContains(entry, ip); ok {
+			rs = append(rs, entry)
+		}
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+func (w *defaultWatcher) Close() error {
+	if w.fw == nil {
+		return nil
+	}
+	return w.fw.Close()
+}
@@ -0,0 +1,52 @@
+package userlist
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffIPSet(t *testing.T) {
+	old := map[string]struct{}{"1.1.1.1": {}, "2.2.2.2": {}}
+	cur := map[string]struct{}{"2.2.2.2": {}, "3.3.3.3": {}}
+	d := diffIPSet(old, cur)
+	assert.Equal(t, []string{"3.3.3.3"}, d.Added)
+	assert.Equal(t, []string{"1.1.1.1"}, d.Removed)
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "blacklist-a"), []byte("1.1.1.1\n2.2.2.2\n"), 0644)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "other"), []byte("9.9.9.9\n"), 0644)
+	assert.NoError(t, err)
+	w, err := NewWatcher(dir, "blacklist-")
+	assert.NoError(t, err)
+	defer w.Close()
+	ctx := context.Background()
+	ips, err := w.Load(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, ips)
+	assert.True(t, w.Contains("1.1.1.1"))
+	assert.False(t, w.Contains("9.9.9.9"))
+
+	ch := make(chan *Diff, 1)
+	err = w.Watch(ctx, func(ctx context.Context, diff *Diff) {
+		ch <- diff
+	})
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "blacklist-a"), []byte("2.2.2.2\n3.3.3.3/24\n"), 0644)
+	assert.NoError(t, err)
+	select {
+	case d := <-ch:
+		assert.Equal(t, []string{"3.3.3.3/24"}, d.Added)
+		assert.Equal(t, []string{"1.1.1.1"}, d.Removed)
+		assert.Equal(t, []string{"3.3.3.3/24"}, w.Match("3.3.3.8"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait diff timeout")
+	}
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IsIPv4 判断ip或者cidr是否为ipv4地址
+func IsIPv4(s string) (bool, error) {
+	var ip net.IP
+	if strings.Contains(s, "/") {
+		parsed, _, err := net.ParseCIDR(s)
+		if err != nil {
+			return false, fmt.Errorf("parse cidr:%s failed, err:%w", s, err)
+		}
+		ip = parsed
+	} else {
+		ip = net.ParseIP(s)
+	}
+	if ip == nil {
+		return false, fmt.Errorf("invalid ip:%s", s)
+	}
+	return ip.To4() != nil, nil
+}
+
+// CanonicalIP 将ip或者cidr转换为规范形式, 与事件处理中产生的ip保持一致
+// 如2001:DB8::1转为2001:db8::1, ::ffff:1.2.3.4转为1.2.3.4, 1.2.3.4/24转为1.2.3.0/24, 掩码为全长的cidr转为单个ip
+func CanonicalIP(s string) (string, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return "", fmt.Errorf("invalid ip:%s", s)
+		}
+		return ip.String(), nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", fmt.Errorf("parse cidr:%s failed, err:%w", s, err)
+	}
+	if ones, bits := ipnet.Mask.Size(); ones == bits {
+		return ipnet.IP.String(), nil
+	}
+	return ipnet.String(), nil
+}
+
+// IPContains 判断ip是否落在entry(ip或者cidr)中
+func IPContains(entry string, ip string) (bool, error) {
+	target := net.ParseIP(ip)
+	if target == nil {
+		return false, fmt.Errorf("invalid ip:%s", ip)
+	}
+	if strings.Contains(entry, "/") {
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return false, fmt.Errorf("parse cidr:%s failed, err:%w", entry, err)
+		}
+		return ipnet.Contains(target), nil
+	}
+	eip := net.ParseIP(entry)
+	if eip == nil {
+		return false, fmt.Errorf("invalid ip:%s", entry)
+	}
+	return eip.Equal(target), nil
+}
+
+// ParseIPNet 将ip或者cidr统一解析为网段, 单个ip视为/32或/128
+func ParseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse cidr:%s failed, err:%w", s, err)
+		}
+		return ipnet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip:%s", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// IPPrefixOf 返回ip所在的指定长度的网段, 例如1.2.3.4在24位下为1.2.3.0/24
+func IPPrefixOf(ip string, ones int) (string, error) {
+	target := net.ParseIP(ip)
+	if target == nil {
+		return "", fmt.Errorf("invalid ip:%s", ip)
+	}
+	bits := 128
+	if v4 := target.To4(); v4 != nil {
+		target, bits = v4, 32
+	}
+	if ones < 0 || ones > bits {
+		return "", fmt.Errorf("invalid prefix length:%d for ip:%s", ones, ip)
+	}
+	ipnet := &net.IPNet{IP: target.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}
+	return ipnet.String(), nil
+}
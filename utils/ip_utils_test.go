@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalIP(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3.4":        "1.2.3.4",
+		"2001:DB8::1":    "2001:db8::1",
+		"::ffff:1.2.3.4": "1.2.3.4",
+		"1.2.3.4/24":     "1.2.3.0/24",
+		"1.2.3.4/32":     "1.2.3.4",
+		"2001:db8::1/48": "2001:db8::/48",
+	}
+	for in, out := range tests {
+		rs, err := CanonicalIP(in)
+		assert.NoError(t, err)
+		assert.Equal(t, out, rs, in)
+	}
+	for _, in := range []string{"", "1.2.3", "1.2.3.4/33", "abc"} {
+		_, err := CanonicalIP(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestIPContains(t *testing.T) {
+	ok, err := IPContains("10.0.0.0/8", "10.1.2.3")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = IPContains("fe80::/10", "1.2.3.4")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = IPContains("1.2.3.4", "1.2.3.4")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	_, err = IPContains("1.2.3.4", "abc")
+	assert.Error(t, err)
+}
+
+func TestIPPrefixOf(t *testing.T) {
+	rs, err := IPPrefixOf("1.2.3.4", 24)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.0/24", rs)
+	rs, err = IPPrefixOf("1.2.3.4", 16)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.0.0/16", rs)
+	rs, err = IPPrefixOf("2001:db8:1:2:3::1", 48)
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8:1::/48", rs)
+	_, err = IPPrefixOf("1.2.3.4", 33)
+	assert.Error(t, err)
+}